@@ -0,0 +1,203 @@
+package cron
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/json-iterator/go"
+	"github.com/xtrafrancyz/bwp/worker"
+)
+
+// Entry is a periodic job from the schedules file.
+type Entry struct {
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"`
+	// Action of the job, http by default
+	Action   string          `json:"action"`
+	Priority worker.Priority `json:"priority"`
+	// Job in the same format as in the web api
+	Job jsoniter.RawMessage `json:"job"`
+}
+
+// Cron adds jobs of the entries to the pool on schedule. The next run of an entry is
+// skipped while any job of the previous one is still queued or running.
+type Cron struct {
+	pool    *worker.Pool
+	entries []*entry
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+type entry struct {
+	Entry
+	schedule Schedule
+
+	// Jobs of every run are tagged, so the unfinished ones are known without job statuses
+	tag string
+
+	mu      sync.Mutex
+	lastRun time.Time
+
+	runs    *metrics.Counter
+	skipped *metrics.Counter
+	errors  *metrics.Counter
+}
+
+// Load reads the json array of entries from the file.
+func Load(path string) ([]Entry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	if err = jsoniter.ConfigFastest.Unmarshal(b, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func New(pool *worker.Pool, entries []Entry) (*Cron, error) {
+	c := &Cron{
+		pool: pool,
+		stop: make(chan struct{}),
+	}
+	names := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		if e.Name == "" {
+			return nil, errors.New("schedule name is empty")
+		}
+		if names[e.Name] {
+			return nil, fmt.Errorf("duplicate schedule %s", e.Name)
+		}
+		names[e.Name] = true
+		if e.Action == "" {
+			e.Action = "http"
+		}
+		schedule, err := Parse(e.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %s: %w", e.Name, err)
+		}
+		decoder := pool.GetDecoder(e.Action)
+		if decoder == nil {
+			return nil, fmt.Errorf("schedule %s: action %s can not be decoded", e.Name, e.Action)
+		}
+		// Check the job once, so the errors are found on startup
+		jobs, err := decode(decoder, e.Job)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %s: %w", e.Name, err)
+		}
+		worker.ReleaseJobs(jobs)
+		c.entries = append(c.entries, newEntry(e, schedule))
+	}
+	return c, nil
+}
+
+func newEntry(e Entry, schedule Schedule) *entry {
+	en := &entry{
+		Entry:    e,
+		schedule: schedule,
+		tag:      "schedule:" + e.Name,
+		runs:     metrics.NewCounter(`schedule_runs{name="` + e.Name + `"}`),
+		skipped:  metrics.NewCounter(`schedule_skipped{name="` + e.Name + `"}`),
+		errors:   metrics.NewCounter(`schedule_errors{name="` + e.Name + `"}`),
+	}
+	metrics.NewGauge(`schedule_last_run{name="`+e.Name+`"}`, func() float64 {
+		en.mu.Lock()
+		defer en.mu.Unlock()
+		if en.lastRun.IsZero() {
+			return 0
+		}
+		return float64(en.lastRun.Unix())
+	})
+	return en
+}
+
+func (c *Cron) Start() {
+	for _, e := range c.entries {
+		c.wg.Add(1)
+		go c.loop(e)
+	}
+}
+
+// Stop stops adding new jobs, already added ones are not affected.
+func (c *Cron) Stop() {
+	close(c.stop)
+	c.wg.Wait()
+}
+
+func (c *Cron) loop(e *entry) {
+	defer c.wg.Done()
+	for {
+		now := time.Now()
+		next := e.schedule.Next(now)
+		if next.IsZero() {
+			log.Printf("Schedule %s never runs", e.Name)
+			return
+		}
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-c.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+			c.run(e)
+		}
+	}
+}
+
+func (c *Cron) run(e *entry) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if n := c.pool.CountTag(e.tag); n > 0 {
+		e.skipped.Inc()
+		log.Printf("Schedule %s is skipped, %d jobs of the previous run are still queued or running", e.Name, n)
+		return
+	}
+	jobs, err := decode(c.pool.GetDecoder(e.Action), e.Job)
+	if err != nil {
+		e.errors.Inc()
+		log.Printf("Schedule %s: %s", e.Name, err)
+		return
+	}
+	for i := range jobs {
+		// Options of the job take precedence over the priority of the entry
+		opts := []worker.JobOption{worker.WithPriority(e.Priority)}
+		jobs[i].Options = append(append(opts, jobs[i].Options...), worker.Tags(e.tag))
+	}
+	if _, err = c.pool.AddJobs(e.Action, jobs); err != nil {
+		worker.ReleaseJobs(jobs)
+		e.errors.Inc()
+		log.Printf("Schedule %s: could not add jobs: %s", e.Name, err)
+		return
+	}
+	e.runs.Inc()
+	e.lastRun = time.Now()
+}
+
+// decode reads the job the same way as the web api does: all options of the job are kept, the
+// job may be an array of items with dependencies. Nothing is returned if any item is invalid.
+func decode(decoder worker.Decoder, body []byte) ([]worker.NewJob, error) {
+	items, errs, err := worker.DecodeItems(decoder, body, "")
+	if err != nil {
+		return nil, err
+	}
+	var jobs []worker.NewJob
+	for i := range items {
+		if errs[i] != nil {
+			for _, item := range items {
+				worker.ReleaseJobs(item)
+			}
+			return nil, errs[i]
+		}
+		jobs = append(jobs, items[i]...)
+	}
+	if len(jobs) == 0 {
+		return nil, errors.New("job is empty")
+	}
+	return jobs, nil
+}
@@ -0,0 +1,72 @@
+package cron
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/json-iterator/go"
+	"github.com/xtrafrancyz/bwp/worker"
+)
+
+// testDecoder takes the job as its data and reads the delay option like the web api does.
+type testDecoder struct{}
+
+func (testDecoder) Decode(b []byte) ([]worker.NewJob, error) {
+	var req struct {
+		Data  string `json:"data"`
+		Delay int    `json:"delay"`
+	}
+	if err := jsoniter.Unmarshal(b, &req); err != nil {
+		return nil, err
+	}
+	return []worker.NewJob{{
+		Data:    req.Data,
+		Options: []worker.JobOption{worker.Delay(time.Duration(req.Delay) * time.Millisecond)},
+	}}, nil
+}
+
+func (testDecoder) Schema() []byte {
+	return nil
+}
+
+func TestRun(t *testing.T) {
+	p := &worker.Pool{Size: 1, QueueSize: 10, ScheduleSize: 10}
+	p.Init()
+	done := make(chan any, 10)
+	p.RegisterAction("test", func(_ context.Context, data any) error {
+		done <- data
+		return nil
+	})
+	p.RegisterDecoder("test", testDecoder{})
+	p.Start()
+	defer p.Finish(0)
+
+	if _, err := New(p, []Entry{{Name: "bad", Schedule: "@hourly", Action: "test", Job: []byte(`{"data":1}`)}}); err == nil {
+		t.Fatal("The invalid job must be rejected on load")
+	}
+	c, err := New(p, []Entry{{Name: "test", Schedule: "@hourly", Action: "test", Job: []byte(`{"data":"a","delay":100}`)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := c.entries[0]
+	c.run(e)
+	// The delayed job of the first run is pending
+	c.run(e)
+	if e.runs.Get() != 1 || e.skipped.Get() != 1 {
+		t.Fatalf("The second run must be skipped, got %d runs and %d skipped", e.runs.Get(), e.skipped.Get())
+	}
+	select {
+	case data := <-done:
+		if data != "a" {
+			t.Errorf("Expected job a, got %v", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The job is not done")
+	}
+	time.Sleep(10 * time.Millisecond)
+	c.run(e)
+	if e.runs.Get() != 2 {
+		t.Errorf("The run after the finished job must add it again, got %d runs", e.runs.Get())
+	}
+}
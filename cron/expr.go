@@ -0,0 +1,165 @@
+package cron
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule returns the next activation time after t.
+type Schedule interface {
+	Next(t time.Time) time.Time
+}
+
+type every struct {
+	interval time.Duration
+}
+
+func (e every) Next(t time.Time) time.Time {
+	return t.Add(e.interval)
+}
+
+// expr is a standard 5 fields cron expression: minute hour day-of-month month day-of-week.
+type expr struct {
+	minute, hour, dom, month, dow uint64
+	// Day of month or day of week is not *, then a day matches any of them
+	domStar, dowStar bool
+}
+
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses a cron expression like "*/5 * * * *", a descriptor like "@hourly"
+// or an interval like "@every 1m30s".
+func Parse(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		interval, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if err != nil {
+			return nil, err
+		}
+		if interval <= 0 {
+			return nil, errors.New("interval must be positive")
+		}
+		return every{interval: interval}, nil
+	}
+	if d, ok := descriptors[spec]; ok {
+		spec = d
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, found %d: %s", len(fields), spec)
+	}
+	e := &expr{}
+	var err error
+	if e.minute, err = parseField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if e.hour, err = parseField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if e.dom, err = parseField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if e.month, err = parseField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if e.dow, err = parseField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// 7 is also sunday
+	if e.dow&(1<<7) != 0 {
+		e.dow |= 1
+	}
+	e.domStar = fields[2] == "*"
+	e.dowStar = fields[4] == "*"
+	return e, nil
+}
+
+// parseField parses comma separated list of "*", "a", "a-b" with optional "/step" into a bitset.
+func parseField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %s", part)
+			}
+		}
+		var from, to int
+		if rng == "*" {
+			from, to = min, max
+		} else if a, b, isRange := strings.Cut(rng, "-"); isRange {
+			var err0, err1 error
+			from, err0 = strconv.Atoi(a)
+			to, err1 = strconv.Atoi(b)
+			if err0 != nil || err1 != nil {
+				return 0, fmt.Errorf("invalid range %s", rng)
+			}
+		} else {
+			var err error
+			if from, err = strconv.Atoi(rng); err != nil {
+				return 0, fmt.Errorf("invalid value %s", rng)
+			}
+			to = from
+			if hasStep {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("%s is out of range %d-%d", part, min, max)
+		}
+		for i := from; i <= to; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+func (e *expr) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Every matching time is found within a few years, otherwise the expression
+	// never matches (like 30th of february)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if e.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !e.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if e.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if e.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (e *expr) dayMatches(t time.Time) bool {
+	dom := e.dom&(1<<uint(t.Day())) != 0
+	dow := e.dow&(1<<uint(t.Weekday())) != 0
+	if e.domStar || e.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
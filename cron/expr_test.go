@@ -0,0 +1,42 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	from := time.Date(2026, 10, 17, 10, 17, 30, 0, time.UTC)
+	checkNext(t, "* * * * *", from, "2026-10-17 10:18")
+	checkNext(t, "*/15 * * * *", from, "2026-10-17 10:30")
+	checkNext(t, "5 * * * *", from, "2026-10-17 11:05")
+	checkNext(t, "0 9-17/4 * * *", from, "2026-10-17 13:00")
+	checkNext(t, "0 0 1 * *", from, "2026-11-01 00:00")
+	checkNext(t, "@hourly", from, "2026-10-17 11:00")
+	checkNext(t, "@yearly", from, "2027-01-01 00:00")
+	// 2026-10-17 is saturday
+	checkNext(t, "30 8 * * 1-5", from, "2026-10-19 08:30")
+	checkNext(t, "0 0 * * 7", from, "2026-10-18 00:00")
+	// Day of month or day of week
+	checkNext(t, "0 0 20 * 0", from, "2026-10-18 00:00")
+	checkNext(t, "0 0 29 2 *", from, "2028-02-29 00:00")
+	checkNext(t, "@every 90s", from, "2026-10-17 10:19")
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "@every -1s"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Expression %q must be invalid", spec)
+		}
+	}
+}
+
+func checkNext(t *testing.T, spec string, from time.Time, expected string) {
+	t.Helper()
+	s, err := Parse(spec)
+	if err != nil {
+		t.Errorf("Could not parse %q: %s", spec, err)
+		return
+	}
+	if next := s.Next(from).Format("2006-01-02 15:04"); next != expected {
+		t.Errorf("Next time of %q is %s, must be %s", spec, next, expected)
+	}
+}
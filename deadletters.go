@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/fasthttp/router"
+	"github.com/valyala/fasthttp"
+	"github.com/xtrafrancyz/bwp/worker"
+)
+
+func (ws *WebServer) registerDeadLetterRoutes(r *router.Router) {
+	r.GET("/dead-letters", ws.handleListDeadLetters)
+	r.DELETE("/dead-letters", ws.handlePurgeDeadLetters)
+	r.POST("/dead-letters/replay", ws.handleReplayDeadLetters)
+	r.GET("/dead-letters/{id}", ws.handleGetDeadLetter)
+	r.DELETE("/dead-letters/{id}", ws.handleDeleteDeadLetter)
+	r.POST("/dead-letters/{id}/replay", ws.handleReplayDeadLetter)
+}
+
+func (ws *WebServer) handleListDeadLetters(ctx *fasthttp.RequestCtx) {
+	filter, ok := parseDeadLetterFilter(ctx)
+	if !ok {
+		return
+	}
+	limit, _ := strconv.Atoi(string(ctx.QueryArgs().Peek("limit")))
+	writeJson(ctx, ws.pool.DeadLetters.List(filter, limit))
+}
+
+func (ws *WebServer) handleGetDeadLetter(ctx *fasthttp.RequestCtx) {
+	id, ok := parseIdParam(ctx)
+	if !ok {
+		return
+	}
+	l, ok := ws.pool.DeadLetters.Get(id)
+	if !ok {
+		ctx.Error("Dead letter not found", 404)
+		return
+	}
+	writeJson(ctx, l)
+}
+
+func (ws *WebServer) handleDeleteDeadLetter(ctx *fasthttp.RequestCtx) {
+	id, ok := parseIdParam(ctx)
+	if !ok {
+		return
+	}
+	if !ws.pool.DeadLetters.Remove(id) {
+		ctx.Error("Dead letter not found", 404)
+		return
+	}
+	writeJson(ctx, map[string]any{"success": true})
+}
+
+func (ws *WebServer) handlePurgeDeadLetters(ctx *fasthttp.RequestCtx) {
+	filter, ok := parseDeadLetterFilter(ctx)
+	if !ok {
+		return
+	}
+	writeJson(ctx, map[string]any{"success": true, "removed": ws.pool.DeadLetters.Purge(filter)})
+}
+
+func (ws *WebServer) handleReplayDeadLetter(ctx *fasthttp.RequestCtx) {
+	id, ok := parseIdParam(ctx)
+	if !ok {
+		return
+	}
+	newID, err := ws.pool.ReplayDeadLetter(id)
+	if err == worker.ErrNotFound {
+		ctx.Error("Dead letter not found", 404)
+		return
+	} else if err != nil {
+		ctx.Error(err.Error(), 503)
+		return
+	}
+	writeJson(ctx, map[string]any{"success": true, "ids": []string{strconv.FormatUint(newID, 10)}})
+}
+
+func (ws *WebServer) handleReplayDeadLetters(ctx *fasthttp.RequestCtx) {
+	filter, ok := parseDeadLetterFilter(ctx)
+	if !ok {
+		return
+	}
+	ids, err := ws.pool.ReplayDeadLetters(filter)
+	sids := make([]string, len(ids))
+	for i, id := range ids {
+		sids[i] = strconv.FormatUint(id, 10)
+	}
+	response := map[string]any{"success": err == nil, "ids": sids}
+	if err != nil {
+		response["error"] = err.Error()
+	}
+	writeJson(ctx, response)
+	if err != nil {
+		ctx.SetStatusCode(503)
+	}
+}
+
+func parseDeadLetterFilter(ctx *fasthttp.RequestCtx) (worker.DeadLetterFilter, bool) {
+	args := ctx.QueryArgs()
+	filter := worker.DeadLetterFilter{
+		Action: string(args.Peek("action")),
+		Error:  string(args.Peek("error")),
+	}
+	var err error
+	if value := args.Peek("before"); len(value) != 0 {
+		if filter.Before, err = time.Parse(time.RFC3339, string(value)); err != nil {
+			ctx.Error("Invalid before, must be RFC 3339 time", 400)
+			return filter, false
+		}
+	}
+	if value := args.Peek("after"); len(value) != 0 {
+		if filter.After, err = time.Parse(time.RFC3339, string(value)); err != nil {
+			ctx.Error("Invalid after, must be RFC 3339 time", 400)
+			return filter, false
+		}
+	}
+	return filter, true
+}
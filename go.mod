@@ -5,6 +5,7 @@ go 1.19
 require (
 	github.com/ReneKroon/ttlcache/v2 v2.11.0
 	github.com/VictoriaMetrics/metrics v1.23.1
+	github.com/andybalholm/brotli v1.0.4
 	github.com/facebookarchive/grace v0.0.0-20180706040059-75cf19382434
 	github.com/fasthttp/router v1.4.15
 	github.com/json-iterator/go v1.1.12
@@ -14,7 +15,6 @@ require (
 )
 
 require (
-	github.com/andybalholm/brotli v1.0.4 // indirect
 	github.com/facebookgo/ensure v0.0.0-20160127193407-b4ab57deab51 // indirect
 	github.com/facebookgo/freeport v0.0.0-20150612182905-d4adf43b75b9 // indirect
 	github.com/facebookgo/stack v0.0.0-20160209184415-751773369052 // indirect
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/facebookarchive/grace/gracenet"
+	"github.com/xtrafrancyz/bwp/worker"
+)
+
+const handoffDialTimeout = 3 * time.Second
+
+// listenHandoff opens the unix socket which receives queued jobs from the previous
+// process. The socket is inherited by every next process on graceful restart.
+func listenHandoff(gnet *gracenet.Net, path string, pool *worker.Pool) (*net.UnixListener, error) {
+	if !inherited {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	ln, err := gnet.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	uln := ln.(*net.UnixListener)
+	// The socket is shared with the next process, so it must stay on disk
+	uln.SetUnlinkOnClose(false)
+
+	go func() {
+		for {
+			conn, err := uln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				received, err := pool.ReceiveHandoff(conn)
+				_ = conn.Close()
+				if err != nil {
+					log.Printf("Handoff from the old process is interrupted: %s", err.Error())
+				}
+				log.Printf("Received %d jobs from the old process", received)
+			}()
+		}
+	}()
+	return uln, nil
+}
+
+// handoffJobs sends queued jobs to the new process, which has inherited the listener.
+func handoffJobs(ln *net.UnixListener, pool *worker.Pool) {
+	path := ln.Addr().String()
+	// Stop accepting here, so the connection goes to the new process
+	_ = ln.Close()
+
+	sent, err := pool.Handoff(func() (net.Conn, error) {
+		conn, err := net.DialTimeout("unix", path, handoffDialTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to the new process: %w", err)
+		}
+		return conn, nil
+	})
+	if err != nil {
+		log.Printf("Handoff to the new process is interrupted: %s", err.Error())
+	}
+	log.Printf("Handed off %d jobs to the new process", sent)
+}
@@ -0,0 +1,211 @@
+package http
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// Requests are rejected this long while the probe request is running
+const halfOpenRetryDelay = time.Second
+
+var (
+	mBreakerOpened   = metrics.NewCounter(`http_breaker_opened`)
+	mBreakerRejected = metrics.NewCounter(`http_breaker_rejected`)
+)
+
+// Breakers keeps circuit breakers of destination hosts. After Failures consecutive
+// failed requests the circuit of the host opens and requests to it are parked for
+// OpenTimeout, then a single probe request decides whether to close the circuit.
+type Breakers struct {
+	failures    int
+	openTimeout time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*breaker
+}
+
+type breaker struct {
+	state    BreakerState
+	failures int
+	opened   time.Time
+	probing  bool
+}
+
+// BreakerStatus describes the circuit of the host which is not closed or has recent failures.
+type BreakerStatus struct {
+	Host     string       `json:"host"`
+	State    BreakerState `json:"state"`
+	Failures int          `json:"failures"`
+	Opened   *time.Time   `json:"opened,omitempty"`
+}
+
+// NewBreakers returns nil if failures is not positive, nil Breakers never open.
+func NewBreakers(failures int, openTimeout time.Duration) *Breakers {
+	if failures <= 0 {
+		return nil
+	}
+	return &Breakers{
+		failures:    failures,
+		openTimeout: openTimeout,
+		hosts:       make(map[string]*breaker),
+	}
+}
+
+func breakerMetric(host string) string {
+	return `http_breaker_state{host="` + host + `"}`
+}
+
+// allow checks whether a request to the host can be sent now, otherwise it returns
+// the delay after which the circuit can let requests through.
+func (b *Breakers) allow(host string) (time.Duration, bool) {
+	if b == nil {
+		return 0, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br, ok := b.hosts[host]
+	if !ok || br.state == BreakerClosed {
+		return 0, true
+	}
+	if br.state == BreakerOpen {
+		if wait := b.openTimeout - time.Since(br.opened); wait > 0 {
+			return wait, false
+		}
+		br.state = BreakerHalfOpen
+	}
+	if br.probing {
+		return halfOpenRetryDelay, false
+	}
+	br.probing = true
+	return 0, true
+}
+
+func (b *Breakers) success(host string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br, ok := b.hosts[host]
+	if !ok {
+		return
+	}
+	if br.state != BreakerClosed {
+		log.Printf("http: circuit of %s is closed", host)
+	}
+	delete(b.hosts, host)
+	metrics.UnregisterMetric(breakerMetric(host))
+}
+
+// abandon lets another probe through after the probe request is cancelled, the cancelled
+// request is neither a success nor a failure of the host.
+func (b *Breakers) abandon(host string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if br, ok := b.hosts[host]; ok {
+		br.probing = false
+	}
+}
+
+func (b *Breakers) failure(host string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br, ok := b.hosts[host]
+	if !ok {
+		br = &breaker{state: BreakerClosed}
+		b.hosts[host] = br
+		metrics.GetOrCreateGauge(breakerMetric(host), func() float64 {
+			return b.stateValue(host)
+		})
+	}
+	br.failures++
+	br.probing = false
+	if br.state == BreakerHalfOpen || (br.state == BreakerClosed && br.failures >= b.failures) {
+		if br.state == BreakerClosed {
+			log.Printf("http: circuit of %s is open after %d failures", host, br.failures)
+		}
+		br.state = BreakerOpen
+		br.opened = time.Now()
+		mBreakerOpened.Inc()
+	}
+}
+
+// stateValue returns 0 for closed, 1 for half-open and 2 for open circuit.
+func (b *Breakers) stateValue(host string) float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br, ok := b.hosts[host]
+	if !ok {
+		return 0
+	}
+	switch br.state {
+	case BreakerOpen:
+		return 2
+	case BreakerHalfOpen:
+		return 1
+	}
+	return 0
+}
+
+// List returns circuits of hosts with recent failures.
+func (b *Breakers) List() []BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list := make([]BreakerStatus, 0, len(b.hosts))
+	for host, br := range b.hosts {
+		status := BreakerStatus{
+			Host:     host,
+			State:    br.state,
+			Failures: br.failures,
+		}
+		if br.state != BreakerClosed {
+			opened := br.opened
+			status.Opened = &opened
+		}
+		list = append(list, status)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Host < list[j].Host
+	})
+	return list
+}
+
+// Reset closes the circuit of the host.
+func (b *Breakers) Reset(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.hosts[host]; !ok {
+		return false
+	}
+	delete(b.hosts, host)
+	metrics.UnregisterMetric(breakerMetric(host))
+	log.Printf("http: circuit of %s is reset", host)
+	return true
+}
+
+type circuitOpenError struct {
+	host string
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("circuit of %s is open", e.host)
+}
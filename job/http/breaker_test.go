@@ -0,0 +1,57 @@
+package http
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	b := NewBreakers(2, 50*time.Millisecond)
+	host := "example.com"
+	b.failure(host)
+	if _, ok := b.allow(host); !ok {
+		t.Fatal("Circuit must be closed after 1 failure")
+	}
+	b.failure(host)
+	if wait, ok := b.allow(host); ok || wait <= 0 {
+		t.Fatal("Circuit must be open after 2 failures")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := b.allow(host); !ok {
+		t.Fatal("Probe request must be allowed")
+	}
+	if _, ok := b.allow(host); ok {
+		t.Fatal("Only one probe request must be allowed")
+	}
+	b.failure(host)
+	if _, ok := b.allow(host); ok {
+		t.Fatal("Circuit must be open again after failed probe")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := b.allow(host); !ok {
+		t.Fatal("Probe request must be allowed")
+	}
+	b.success(host)
+	if _, ok := b.allow(host); !ok || len(b.List()) != 0 {
+		t.Fatal("Circuit must be closed after successful probe")
+	}
+}
+
+func TestBreakerAbandonedProbe(t *testing.T) {
+	b := NewBreakers(1, 10*time.Millisecond)
+	host := "example.org"
+	b.failure(host)
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := b.allow(host); !ok {
+		t.Fatal("Probe request must be allowed")
+	}
+	b.abandon(host)
+	if _, ok := b.allow(host); !ok {
+		t.Fatal("Another probe must be allowed after the cancelled one")
+	}
+	if list := b.List(); len(list) != 1 || list[0].State != BreakerHalfOpen || list[0].Failures != 1 {
+		t.Errorf("The cancelled probe must not change the circuit, got %+v", list)
+	}
+}
@@ -0,0 +1,189 @@
+package http
+
+import (
+	"encoding/base64"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/json-iterator/go"
+	"github.com/valyala/bytebufferpool"
+	"github.com/xtrafrancyz/bwp/worker"
+)
+
+var (
+	mCallbacks       = metrics.NewCounter(`http_callbacks`)
+	mCallbacksFailed = metrics.NewCounter(`http_callbacks_failed`)
+)
+
+// callback is the request which receives the report of the finished http job.
+type callback struct {
+	url     string
+	method  string
+	headers map[string]string
+	// Response headers to include into the report
+	responseHeaders []string
+}
+
+// CallbackHook queues the report of the finished http job to its callback as a new http job.
+// The response body in the report is truncated to bodyLimit.
+func CallbackHook(pool *worker.Pool, bodyLimit int) worker.FinishHook {
+	return func(res *worker.JobResult, input any) {
+		data := input.(*requestData)
+		if data.callback == nil {
+			return
+		}
+		cb := acquireRequestData()
+		cb.url = data.callback.url
+		cb.method = data.callback.method
+		cb.headers = make(map[string]string, len(data.callback.headers)+1)
+		cb.headers["Content-Type"] = "application/json"
+		for k, v := range data.callback.headers {
+			cb.headers[k] = v
+		}
+		cb.body = bytebufferpool.Get()
+		cb.body.B = writeReport(cb.body.B, res, data, bodyLimit)
+		cb.bodyReleaseCounter = new(int32)
+		*cb.bodyReleaseCounter = 1
+		cb.priority = data.priority
+
+		if _, err := pool.AddJob("http", cb, jobOptions(cb)...); err != nil {
+			log.Printf("http: could not queue callback of job %d: %s", res.ID, err.Error())
+			mCallbacksFailed.Inc()
+			releaseRequestData(cb)
+			return
+		}
+		mCallbacks.Inc()
+	}
+}
+
+func writeReport(buf []byte, res *worker.JobResult, data *requestData, bodyLimit int) []byte {
+	stream := json.BorrowStream(nil)
+	defer json.ReturnStream(stream)
+	stream.WriteObjectStart()
+	stream.WriteObjectField("id")
+	stream.WriteString(strconv.FormatUint(res.ID, 10))
+	stream.WriteMore()
+	stream.WriteObjectField("url")
+	stream.WriteString(data.url)
+	stream.WriteMore()
+	stream.WriteObjectField("method")
+	stream.WriteString(data.method)
+	stream.WriteMore()
+	stream.WriteObjectField("state")
+	switch res.Err {
+	case nil:
+		stream.WriteString(string(worker.StateSucceeded))
+	case worker.ErrCancelled:
+		stream.WriteString(string(worker.StateCancelled))
+	default:
+		stream.WriteString(string(worker.StateFailed))
+	}
+	if data.result.StatusCode != 0 {
+		stream.WriteMore()
+		stream.WriteObjectField("statusCode")
+		stream.WriteInt(data.result.StatusCode)
+	}
+	if data.response != nil {
+		headers := make(map[string]string, len(data.callback.responseHeaders))
+		for _, name := range data.callback.responseHeaders {
+			name = normalizeHeader(name)
+			if value, ok := data.response.headers[name]; ok {
+				headers[name] = value
+			}
+		}
+		if len(headers) > 0 {
+			stream.WriteMore()
+			stream.WriteObjectField("headers")
+			writeStringMap(stream, headers)
+		}
+		body, truncated := data.response.body, data.response.truncated
+		if len(body) > bodyLimit {
+			body, truncated = body[:bodyLimit], true
+		}
+		stream.WriteMore()
+		stream.WriteObjectField("body")
+		stream.WriteString(base64.StdEncoding.EncodeToString(body))
+		if truncated {
+			stream.WriteMore()
+			stream.WriteObjectField("bodyTruncated")
+			stream.WriteTrue()
+		}
+	}
+	if res.Err != nil {
+		stream.WriteMore()
+		stream.WriteObjectField("error")
+		stream.WriteString(res.Err.Error())
+		if data.result.ErrorClass != "" {
+			stream.WriteMore()
+			stream.WriteObjectField("errorClass")
+			stream.WriteString(data.result.ErrorClass)
+		}
+	}
+	stream.WriteMore()
+	stream.WriteObjectField("attempts")
+	stream.WriteInt(res.Attempts)
+	writeTimeField(stream, "queued", res.Queued)
+	writeTimeField(stream, "started", res.Started)
+	writeTimeField(stream, "finished", res.Finished)
+	stream.WriteObjectEnd()
+	return append(buf, stream.Buffer()...)
+}
+
+func writeTimeField(stream *jsoniter.Stream, field string, t time.Time) {
+	stream.WriteMore()
+	stream.WriteObjectField(field)
+	stream.WriteString(t.Format(time.RFC3339Nano))
+}
+
+func unmarshalCallback(iter *jsoniter.Iterator) (*callback, error) {
+	c := &callback{}
+	for field := iter.ReadObject(); field != ""; field = iter.ReadObject() {
+		switch field {
+		case "url":
+			c.url = iter.ReadString()
+		case "method":
+			c.method = iter.ReadString()
+		case "headers":
+			c.headers = make(map[string]string)
+			for name := iter.ReadObject(); name != ""; name = iter.ReadObject() {
+				c.headers[name] = iter.ReadString()
+			}
+		case "responseHeaders":
+			for iter.ReadArray() {
+				c.responseHeaders = append(c.responseHeaders, iter.ReadString())
+			}
+		default:
+			iter.Skip()
+		}
+	}
+	if c.url == "" {
+		return nil, errors.New("invalid request, callback.url is not set")
+	}
+	if c.method == "" {
+		c.method = "POST"
+	}
+	return c, nil
+}
+
+func marshalCallback(stream *jsoniter.Stream, c *callback) {
+	stream.WriteObjectStart()
+	stream.WriteObjectField("url")
+	stream.WriteString(c.url)
+	stream.WriteMore()
+	stream.WriteObjectField("method")
+	stream.WriteString(c.method)
+	if c.headers != nil {
+		stream.WriteMore()
+		stream.WriteObjectField("headers")
+		writeStringMap(stream, c.headers)
+	}
+	if c.responseHeaders != nil {
+		stream.WriteMore()
+		stream.WriteObjectField("responseHeaders")
+		stream.WriteVal(c.responseHeaders)
+	}
+	stream.WriteObjectEnd()
+}
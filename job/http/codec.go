@@ -0,0 +1,108 @@
+package http
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+
+	"github.com/json-iterator/go"
+	"github.com/xtrafrancyz/bwp/worker"
+)
+
+type codec struct{}
+
+// NewCodec returns the codec of http jobs. Jobs are stored in the same json format
+// as accepted by the web api.
+func NewCodec() worker.Codec {
+	return codec{}
+}
+
+func (codec) Marshal(input any) ([]byte, error) {
+	data, ok := input.(*requestData)
+	if !ok {
+		return nil, errors.New("unexpected http job data")
+	}
+	stream := json.BorrowStream(nil)
+	defer json.ReturnStream(stream)
+
+	stream.WriteObjectStart()
+	stream.WriteObjectField("url")
+	stream.WriteString(data.url)
+	stream.WriteMore()
+	stream.WriteObjectField("method")
+	stream.WriteString(data.method)
+	if data.body != nil {
+		stream.WriteMore()
+		stream.WriteObjectField("body")
+		stream.WriteString(base64.StdEncoding.EncodeToString(data.body.B))
+	}
+	if data.parameters != nil {
+		stream.WriteMore()
+		stream.WriteObjectField("parameters")
+		writeStringMap(stream, data.parameters)
+	}
+	if data.headers != nil {
+		stream.WriteMore()
+		stream.WriteObjectField("headers")
+		writeStringMap(stream, data.headers)
+	}
+	if data.hostMetrics {
+		stream.WriteMore()
+		stream.WriteObjectField("hostMetrics")
+		stream.WriteBool(true)
+	}
+	if data.rateLimitKey != "" {
+		stream.WriteMore()
+		stream.WriteObjectField("rateLimitKey")
+		stream.WriteString(data.rateLimitKey)
+	}
+	if data.retry != nil {
+		stream.WriteMore()
+		stream.WriteObjectField("retry")
+		marshalRetryPolicy(stream, data.retry)
+	}
+	if data.storeResponse {
+		stream.WriteMore()
+		stream.WriteObjectField("storeResponse")
+		stream.WriteBool(true)
+	}
+	if data.callback != nil {
+		stream.WriteMore()
+		stream.WriteObjectField("callback")
+		marshalCallback(stream, data.callback)
+	}
+	stream.WriteObjectEnd()
+
+	if stream.Error != nil {
+		return nil, stream.Error
+	}
+	return append([]byte(nil), stream.Buffer()...), nil
+}
+
+func (codec) Unmarshal(b []byte) (any, error) {
+	iter := json.BorrowIterator(b)
+	defer json.ReturnIterator(iter)
+	data, err := unmarshalRequestData(iter, true)
+	if err != nil {
+		return nil, err
+	}
+	if iter.Error != nil && iter.Error != io.EOF {
+		releaseRequestData(data)
+		return nil, iter.Error
+	}
+	return data, nil
+}
+
+func writeStringMap(stream *jsoniter.Stream, m map[string]string) {
+	stream.WriteObjectStart()
+	first := true
+	for k, v := range m {
+		if !first {
+			stream.WriteMore()
+		}
+		first = false
+		stream.WriteObjectField(k)
+		stream.WriteString(v)
+	}
+	stream.WriteObjectEnd()
+}
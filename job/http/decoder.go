@@ -0,0 +1,117 @@
+package http
+
+import (
+	"errors"
+	"io"
+
+	"github.com/xtrafrancyz/bwp/worker"
+)
+
+type decoder struct{}
+
+// NewDecoder returns the decoder of http jobs submitted to the generic web api. Every
+// clone of the request becomes a separate job, clones may depend on earlier clones.
+func NewDecoder() worker.Decoder {
+	return decoder{}
+}
+
+func (decoder) Decode(b []byte) ([]worker.NewJob, error) {
+	iter := json.BorrowIterator(b)
+	defer json.ReturnIterator(iter)
+	data, err := unmarshalRequestData(iter, true)
+	if err != nil {
+		return nil, err
+	}
+	if iter.Error != nil && iter.Error != io.EOF {
+		releaseRequestData(data)
+		return nil, iter.Error
+	}
+	key := data.idempotencyKey
+	coalesceKey, coalesceMode, coalesceWindow := data.coalesceKey, data.coalesceMode, data.coalesceWindow
+	clones := expandClones(data)
+	jobs := make([]worker.NewJob, len(clones))
+	refs := make(map[string]int)
+	for i, c := range clones {
+		if c.ref != "" {
+			if _, ok := refs[c.ref]; ok {
+				releaseClones(clones)
+				return nil, errors.New("invalid request, duplicate ref " + c.ref)
+			}
+			refs[c.ref] = i
+		}
+		if c.dependsOn != nil {
+			if jobs[i].DependsOn, err = worker.ResolveDependsOn(c.dependsOn, i, refs); err != nil {
+				releaseClones(clones)
+				return nil, errors.New("invalid request, " + err.Error())
+			}
+		}
+		// Every clone is a separate job with its own keys
+		if c.idempotencyKey == "" && key != "" {
+			c.idempotencyKey = worker.SubKey(key, i, len(clones))
+		}
+		if c.coalesceKey == "" && coalesceKey != "" {
+			c.coalesceKey = worker.SubKey(coalesceKey, i, len(clones))
+			c.coalesceMode, c.coalesceWindow = coalesceMode, coalesceWindow
+		}
+		jobs[i].Data, jobs[i].Options = c, jobOptions(c)
+	}
+	return jobs, nil
+}
+
+func releaseClones(clones []*requestData) {
+	for _, c := range clones {
+		releaseRequestData(c)
+	}
+}
+
+func (decoder) Schema() []byte {
+	return []byte(schema)
+}
+
+const schema = `{
+  "type": "object",
+  "properties": {
+    "url": {"type": "string", "description": "Required unless every clone has the url"},
+    "method": {"type": "string", "default": "GET"},
+    "body": {"type": "string", "contentEncoding": "base64"},
+    "parameters": {"type": "object", "additionalProperties": {"type": "string"}},
+    "headers": {"type": "object", "additionalProperties": {"type": "string"}},
+    "hostMetrics": {"type": "boolean"},
+    "delay": {"type": ["string", "number"], "description": "Duration or seconds"},
+    "runAt": {"type": ["string", "number"], "description": "Unix timestamp or RFC 3339 time"},
+    "priority": {"enum": ["high", "normal", "low"]},
+    "timeout": {"type": ["string", "number"], "description": "Max duration of every attempt, duration or seconds"},
+    "rateLimitKey": {"type": "string"},
+    "idempotencyKey": {"type": "string", "description": "Duplicates are ignored while the key is remembered"},
+    "orderingKey": {"type": "string", "description": "Requests with the same key run one after another in the order of submission"},
+    "tags": {"type": "array", "items": {"type": "string"}, "description": "Pending and running requests can be cancelled by any of their tags"},
+    "coalesceKey": {"type": "string", "description": "Requests with the same key are merged while one of them is pending"},
+    "coalesceMode": {"enum": ["drop", "debounce"], "default": "drop"},
+    "coalesceWindow": {"type": ["string", "number"], "description": "Debounce window, duration or seconds"},
+    "ref": {"type": "string", "description": "Name of the clone or of the array item for dependsOn"},
+    "dependsOn": {"type": "array", "items": {"type": ["integer", "string"]}, "description": "Indexes or refs of earlier clones or array items which must succeed first"},
+    "storeResponse": {"type": "boolean"},
+    "callback": {
+      "type": "object",
+      "properties": {
+        "url": {"type": "string"},
+        "method": {"type": "string", "default": "POST"},
+        "headers": {"type": "object", "additionalProperties": {"type": "string"}},
+        "responseHeaders": {"type": "array", "items": {"type": "string"}}
+      },
+      "required": ["url"]
+    },
+    "retry": {
+      "type": "object",
+      "properties": {
+        "attempts": {"type": "integer", "minimum": 1},
+        "delay": {"type": "string"},
+        "maxDelay": {"type": "string"},
+        "jitter": {"type": "number", "minimum": 0, "maximum": 1},
+        "statuses": {"type": "array", "items": {"type": "integer"}},
+        "errors": {"type": "array", "items": {"enum": ["timeout", "dial", "network", "circuit"]}}
+      }
+    },
+    "clones": {"type": "array", "items": {"type": "object"}, "description": "Requests which inherit unset fields of the root request"}
+  }
+}`
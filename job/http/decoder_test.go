@@ -0,0 +1,38 @@
+package http
+
+import "testing"
+
+func TestDecodeClones(t *testing.T) {
+	jobs, err := NewDecoder().Decode([]byte(`{"method":"POST","headers":{"X-A":"1"},"clones":[{"url":"http://a"},{"url":"http://b","method":"PUT"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("Expected 2 jobs, got %d", len(jobs))
+	}
+	first, second := jobs[0].Data.(*requestData), jobs[1].Data.(*requestData)
+	if first.url != "http://a" || first.method != "POST" || first.headers["X-A"] != "1" {
+		t.Errorf("The clone must inherit fields of the root request")
+	}
+	if second.method != "PUT" {
+		t.Errorf("The clone must keep its own fields")
+	}
+
+	if _, err = NewDecoder().Decode([]byte(`{"method":"POST"}`)); err == nil {
+		t.Error("The request without url must be rejected")
+	}
+}
+
+func TestDecodeCloneDependencies(t *testing.T) {
+	jobs, err := NewDecoder().Decode([]byte(`{"clones":[{"url":"http://a","ref":"first"},{"url":"http://b","dependsOn":["first"]},{"url":"http://c","dependsOn":[0,1]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs[0].DependsOn) != 0 || len(jobs[1].DependsOn) != 1 || len(jobs[2].DependsOn) != 2 {
+		t.Errorf("Clones must depend on earlier clones")
+	}
+
+	if _, err = NewDecoder().Decode([]byte(`{"clones":[{"url":"http://a","dependsOn":["second"]},{"url":"http://b","ref":"second"}]}`)); err == nil {
+		t.Error("The clone must not depend on a later clone")
+	}
+}
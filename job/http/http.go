@@ -1,6 +1,8 @@
 package http
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net/url"
 	"sync"
@@ -21,22 +23,100 @@ type requestData struct {
 	headers     map[string]string
 	hostMetrics bool
 	clones      []*requestData
+	retry       *RetryPolicy
+	runAt       time.Time
+	priority    *worker.Priority
+	// Max duration of every attempt, it is persisted by the pool
+	timeout time.Duration
+	// Requests with the same key share the rate limit instead of the host
+	rateLimitKey string
+	rateReserved bool
+	callback     *callback
+	// Duplicates of the request are ignored while the key is remembered, it is not persisted
+	idempotencyKey string
+	// Requests with the same key are merged while one of them is pending, it is not persisted
+	coalesceKey    string
+	coalesceMode   worker.CoalesceMode
+	coalesceWindow time.Duration
+	// Requests with the same key run one after another in the order of submission
+	orderingKey string
+	// Requests can be cancelled by their tags, they are persisted by the pool
+	tags []string
+	// Name and dependencies of the clone on earlier clones, used only while decoding
+	ref       string
+	dependsOn []byte
+	// Keep the response in the result store
+	storeResponse bool
+	// Api request waiting for the result, it is not persisted
+	waiter chan *StoredResult
+	// Response of the last attempt for the callback, the result store or the waiter
+	response *capturedResponse
+	// Amount of finished attempts
+	attempt int
 
 	bodyReleaseCounter *int32
+
+	// Result of the last attempt
+	result result
+}
+
+type result struct {
+	StatusCode   int    `json:"statusCode,omitempty"`
+	ResponseSize int    `json:"responseSize,omitempty"`
+	ErrorClass   string `json:"errorClass,omitempty"`
+	// Beginning of the failed response
+	Response string `json:"response,omitempty"`
+}
+
+const responseSnippetSize = 1024
+
+// Options of the http job handler.
+type Options struct {
+	Log4xxResponses bool
+	// Default retry policy, requests can override any part of it
+	Retry RetryPolicy
+	// Optional circuit breakers of destination hosts
+	Breakers *Breakers
+	// Optional rate limits of destination hosts
+	RateLimiter *RateLimiter
+	// Max size of the response body sent to the callback
+	CallbackBodyLimit int
+	// Optional store of responses
+	Results *ResultStore
+	// Max time the api request can wait for the result, 0 disables waiting
+	MaxWait time.Duration
+	// Max size of the response body returned to the waiting api request
+	WaitBodyLimit int
+	// Max amount of requests in flight to a single host, 0 means the fasthttp default
+	MaxConnsPerHost int
 }
 
 type jobHandler struct {
 	router          *iprouter.IpRouter
+	breakers        *Breakers
+	rateLimiter     *RateLimiter
+	callbackLimit   int
+	results         *ResultStore
+	waitLimit       int
 	client          *fasthttp.Client
 	log4xxResponses bool
+	retry           RetryPolicy
 	timeoutsByHost  *byHostMetric
 	errorsByHost    *byHostMetric
 }
 
-func NewJobHandler(router *iprouter.IpRouter, log4xxResponses bool) worker.JobHandler {
+// NewJobHandler creates the handler of http jobs. Requests do not occupy workers while waiting
+// for responses, the handler must be registered as an async action.
+func NewJobHandler(router *iprouter.IpRouter, opts Options) worker.AsyncJobHandler {
 	h := &jobHandler{
 		router:          router,
-		log4xxResponses: log4xxResponses,
+		breakers:        opts.Breakers,
+		rateLimiter:     opts.RateLimiter,
+		callbackLimit:   opts.CallbackBodyLimit,
+		results:         opts.Results,
+		waitLimit:       opts.WaitBodyLimit,
+		log4xxResponses: opts.Log4xxResponses,
+		retry:           opts.Retry,
 		timeoutsByHost:  newByHostMetric("http_timeouts_by_host"),
 		errorsByHost:    newByHostMetric("http_errors_by_host"),
 	}
@@ -46,19 +126,37 @@ func NewJobHandler(router *iprouter.IpRouter, log4xxResponses bool) worker.JobHa
 		ReadTimeout:         10 * time.Second,
 		WriteTimeout:        3 * time.Second,
 		MaxResponseBodySize: 256 * 1024, // 256kb
+		MaxConnsPerHost:     opts.MaxConnsPerHost,
+		// Requests wait for a free connection to the busy host instead of failing at once
+		MaxConnWaitTimeout: 10 * time.Second,
 	}
-	return h.handle
+	return h.start
 }
 
-func (h *jobHandler) handle(input any) error {
+// start runs the request in its own goroutine, which sleeps in the network poller until the response comes.
+func (h *jobHandler) start(ctx context.Context, input any, done func(error)) {
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done(fmt.Errorf("panic: %v", r))
+			}
+		}()
+		done(h.handle(ctx, input))
+	}()
+}
+
+func (h *jobHandler) handle(ctx context.Context, input any) error {
 	data := input.(*requestData)
+	if err := ctx.Err(); err != nil {
+		// The job is cancelled before the start
+		return err
+	}
 	start := time.Now()
 
 	// Put parameters directly to the url on GET or HEAD requests
 	if (data.method == "GET" || data.method == "HEAD") && data.parameters != nil && len(data.parameters) != 0 {
 		parsedUrl, err := url.Parse(data.url)
 		if err != nil {
-			releaseRequestData(data)
 			return err
 		}
 		values := parsedUrl.Query()
@@ -70,6 +168,29 @@ func (h *jobHandler) handle(input any) error {
 		data.url = parsedUrl.String()
 	}
 
+	host := hostOf(data.url)
+	if data.rateReserved {
+		// The token was reserved when the job was throttled
+		data.rateReserved = false
+	} else {
+		key := data.rateLimitKey
+		if key == "" {
+			key = host
+		}
+		if wait := h.rateLimiter.reserve(key); wait > 0 {
+			data.rateReserved = true
+			return worker.Postpone(wait)
+		}
+	}
+	if wait, ok := h.breakers.allow(host); !ok {
+		data.attempt++
+		data.result = result{ErrorClass: errorClassCircuit}
+		data.response = nil
+		mBreakerRejected.Inc()
+		policy := h.retry.merge(data.retry)
+		return retryOrFail(data, &policy, &circuitOpenError{host: host}, policy.retryableError(errorClassCircuit), wait)
+	}
+
 	req := fasthttp.AcquireRequest()
 	res := fasthttp.AcquireResponse()
 	req.Header.SetMethod(data.method)
@@ -94,11 +215,36 @@ func (h *jobHandler) handle(input any) error {
 	if data.method == "HEAD" {
 		res.SkipBody = true
 	}
+	var metricsHost string
+	if data.hostMetrics {
+		metricsHost = string(req.Host())
+	}
 
-	err := h.client.Do(req, res)
+	err := h.do(ctx, req, res)
 	elapsed := time.Since(start).Round(100 * time.Microsecond)
+	if err == context.Canceled {
+		// Nobody waits for the result of the cancelled job
+		log.Printf("http: %v %v %v cancelled", elapsed, data.method, data.url)
+		h.breakers.abandon(host)
+		fasthttp.ReleaseRequest(req)
+		fasthttp.ReleaseResponse(res)
+		return err
+	}
 
 	code := res.StatusCode()
+	if err != nil || code >= 500 {
+		h.breakers.failure(host)
+	} else {
+		h.breakers.success(host)
+	}
+	data.attempt++
+	data.result = result{}
+	data.response = nil
+	if err == nil {
+		data.result.StatusCode = code
+		data.result.ResponseSize = len(res.Body())
+		data.response = h.captureResponse(data, res)
+	}
 	if err != nil {
 		if err == fasthttp.ErrTimeout {
 			log.Printf("http: %v %v %v timeout", elapsed, data.method, data.url)
@@ -123,9 +269,9 @@ func (h *jobHandler) handle(input any) error {
 	// Metrics
 	if data.hostMetrics {
 		if err == fasthttp.ErrTimeout || err == fasthttp.ErrDialTimeout {
-			h.timeoutsByHost.inc(string(req.Host()))
+			h.timeoutsByHost.inc(metricsHost)
 		} else if err != nil || code >= 400 {
-			h.errorsByHost.inc(string(req.Host()))
+			h.errorsByHost.inc(metricsHost)
 		}
 	}
 
@@ -140,10 +286,104 @@ func (h *jobHandler) handle(input any) error {
 		m2xx.Inc()
 	}
 
+	policy := h.retry.merge(data.retry)
+	var failure error
+	retryable := false
+	if err != nil {
+		failure = err
+		data.result.ErrorClass = classifyError(err)
+		retryable = policy.retryableError(data.result.ErrorClass)
+	} else if code >= 500 || policy.retryableStatus(code) {
+		failure = fmt.Errorf("unexpected status code %d", code)
+		data.result.ErrorClass = errorClassStatus
+		retryable = policy.retryableStatus(code)
+		body := res.Body()
+		if len(body) > responseSnippetSize {
+			body = body[:responseSnippetSize]
+		}
+		data.result.Response = string(body)
+	}
+	retryAfter := parseRetryAfter(res.Header.Peek(fasthttp.HeaderRetryAfter))
+
 	fasthttp.ReleaseRequest(req)
 	fasthttp.ReleaseResponse(res)
-	releaseRequestData(data)
-	return nil
+	if failure == nil {
+		return nil
+	}
+	return retryOrFail(data, &policy, failure, retryable, retryAfter)
+}
+
+// do sends the request until the deadline of the job. The running request is not interrupted when
+// the job is cancelled, its result is discarded. The expired deadline is reported as fasthttp.ErrTimeout.
+func (h *jobHandler) do(ctx context.Context, req *fasthttp.Request, res *fasthttp.Response) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return contextError(ctx, h.client.Do(req, res))
+	}
+	err := h.client.DoDeadline(req, res, deadline)
+	if err != nil && ctx.Err() == nil && !time.Now().Before(deadline) {
+		// The connection can time out a moment before the context
+		return fasthttp.ErrTimeout
+	}
+	return contextError(ctx, err)
+}
+
+// contextError replaces the failure caused by the done context, the expired deadline is a timeout.
+func contextError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return fasthttp.ErrTimeout
+	case context.Canceled:
+		return context.Canceled
+	}
+	return err
+}
+
+// retryOrFail wraps the failure into worker.Retry if the policy allows one more attempt.
+func retryOrFail(data *requestData, policy *RetryPolicy, failure error, retryable bool, retryAfter time.Duration) error {
+	if !retryable || data.attempt >= policy.Attempts {
+		return failure
+	}
+	delay := policy.backoff(data.attempt, retryAfter)
+	log.Printf("http: retrying %v %v in %v (attempt %d of %d failed)", data.method, data.url, delay, data.attempt, policy.Attempts)
+	mRetries.Inc()
+	return worker.Retry(failure, delay)
+}
+
+// captureResponse keeps the response if it is needed by the callback, the result store or the waiter.
+func (h *jobHandler) captureResponse(data *requestData, res *fasthttp.Response) *capturedResponse {
+	store := data.storeResponse && h.results != nil
+	wait := data.waiter != nil
+	if !store && !wait && data.callback == nil {
+		return nil
+	}
+	var names []string
+	limit := 0
+	if data.callback != nil {
+		names = data.callback.responseHeaders
+		limit = h.callbackLimit
+	}
+	if store && h.results.bodyLimit > limit {
+		limit = h.results.bodyLimit
+	}
+	if wait && h.waitLimit > limit {
+		limit = h.waitLimit
+	}
+	return captureResponse(res, store || wait, names, limit)
+}
+
+func (d *requestData) Report() any {
+	if d.result == (result{}) {
+		return nil
+	}
+	return d.result
+}
+
+func (d *requestData) Release() {
+	releaseRequestData(d)
 }
 
 var requestDataPool sync.Pool
@@ -170,5 +410,29 @@ func releaseRequestData(v *requestData) {
 	v.bodyReleaseCounter = nil
 	v.hostMetrics = false
 	v.clones = nil
+	v.retry = nil
+	v.runAt = time.Time{}
+	v.priority = nil
+	v.timeout = 0
+	v.rateLimitKey = ""
+	v.rateReserved = false
+	v.callback = nil
+	v.idempotencyKey = ""
+	v.coalesceKey = ""
+	v.coalesceMode = worker.CoalesceDrop
+	v.coalesceWindow = 0
+	v.orderingKey = ""
+	v.tags = nil
+	v.ref = ""
+	v.dependsOn = nil
+	v.storeResponse = false
+	if v.waiter != nil {
+		// Wakes up the api request if the job is released without a result, like a duplicate
+		close(v.waiter)
+		v.waiter = nil
+	}
+	v.response = nil
+	v.attempt = 0
+	v.result = result{}
 	requestDataPool.Put(v)
 }
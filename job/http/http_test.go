@@ -0,0 +1,153 @@
+package http
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/xtrafrancyz/bwp/iprouter"
+	"github.com/xtrafrancyz/bwp/worker"
+)
+
+const (
+	benchWorkers  = 50
+	benchInFlight = 2000
+	benchLatency  = 20 * time.Millisecond
+)
+
+// BenchmarkSlowUpstream compares requests to a slow server which run in workers, like before
+// the in-flight budget, with requests which do not occupy workers.
+func BenchmarkSlowUpstream(b *testing.B) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	server := &fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			time.Sleep(benchLatency)
+			ctx.SetBodyString("ok")
+		},
+	}
+	go server.Serve(ln)
+	defer server.Shutdown()
+	url := "http://" + ln.Addr().String() + "/"
+
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	b.Run("workers", func(b *testing.B) {
+		benchmarkPool(b, url, false)
+	})
+	b.Run("inflight", func(b *testing.B) {
+		benchmarkPool(b, url, true)
+	})
+}
+
+func benchmarkPool(b *testing.B, url string, async bool) {
+	pool := &worker.Pool{Size: benchWorkers, QueueSize: b.N, ScheduleSize: 1}
+	pool.Init()
+	wg := &sync.WaitGroup{}
+	finished := worker.OnFinish(func(*worker.JobResult, any) {
+		wg.Done()
+	})
+	handler := NewJobHandler(iprouter.Default, Options{MaxConnsPerHost: benchInFlight})
+	if async {
+		pool.RegisterAsyncAction("http", handler, benchInFlight, finished)
+	} else {
+		pool.RegisterAction("http", func(ctx context.Context, data any) error {
+			// Every request holds its worker until the response comes
+			result := make(chan error, 1)
+			handler(ctx, data, func(err error) {
+				result <- err
+			})
+			return <-result
+		}, finished)
+	}
+	pool.Start()
+	defer pool.Finish(0)
+
+	b.ResetTimer()
+	start := time.Now()
+	wg.Add(b.N)
+	for i := 0; i < b.N; i++ {
+		data := acquireRequestData()
+		data.url = url
+		data.method = "GET"
+		if _, err := pool.AddJob("http", data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	wg.Wait()
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "req/s")
+}
+
+func TestRequestDeadline(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// The server reads requests and never replies, it reports closed connections
+	closed := make(chan struct{}, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(io.Discard, conn)
+				closed <- struct{}{}
+			}()
+		}
+	}()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := NewJobHandler(iprouter.Default, Options{})
+	run := func(ctx context.Context) error {
+		data := acquireRequestData()
+		defer releaseRequestData(data)
+		data.url = "http://" + ln.Addr().String() + "/"
+		data.method = "GET"
+		result := make(chan error, 1)
+		handler(ctx, data, func(err error) {
+			result <- err
+		})
+		select {
+		case err := <-result:
+			return err
+		case <-time.After(time.Second):
+			t.Fatal("The request does not stop at the deadline")
+		}
+		return nil
+	}
+	waitClosed := func() {
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatal("The connection of the timed out request is not closed")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := run(ctx); err != fasthttp.ErrTimeout {
+		t.Errorf("Expected the timeout, got %v", err)
+	}
+	waitClosed()
+
+	// The cancelled request runs until the deadline and its result is discarded
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if err := run(ctx); err != context.Canceled {
+		t.Errorf("Expected the cancelled request, got %v", err)
+	}
+	waitClosed()
+}
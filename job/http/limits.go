@@ -0,0 +1,124 @@
+package http
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// hostPatterns maps host patterns to values. A pattern is a host like "api.example.com",
+// "*.example.com" for the domain with subdomains or "*" for any host.
+type hostPatterns[V any] struct {
+	hosts       map[string]V
+	domains     map[string]V
+	fallback    V
+	hasFallback bool
+}
+
+// parseHostPatterns parses comma separated "pattern=value" pairs.
+func parseHostPatterns[V any](s string, parseValue func(string) (V, error)) (hostPatterns[V], error) {
+	p := hostPatterns[V]{
+		hosts:   make(map[string]V),
+		domains: make(map[string]V),
+	}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		pattern, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return p, fmt.Errorf("invalid host limit %s", part)
+		}
+		v, err := parseValue(strings.TrimSpace(value))
+		if err != nil {
+			return p, fmt.Errorf("invalid host limit %s: %w", part, err)
+		}
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "*" {
+			p.fallback = v
+			p.hasFallback = true
+		} else if strings.HasPrefix(pattern, "*.") {
+			p.domains[pattern[2:]] = v
+		} else {
+			p.hosts[pattern] = v
+		}
+	}
+	return p, nil
+}
+
+// get returns the value of the most specific pattern matching the host.
+func (p hostPatterns[V]) get(host string) (V, bool) {
+	if v, ok := p.hosts[host]; ok {
+		return v, true
+	}
+	for domain := host; domain != ""; {
+		if v, ok := p.domains[domain]; ok {
+			return v, true
+		}
+		_, domain, _ = strings.Cut(domain, ".")
+	}
+	return p.fallback, p.hasFallback
+}
+
+func (p hostPatterns[V]) empty() bool {
+	return len(p.hosts) == 0 && len(p.domains) == 0 && !p.hasFallback
+}
+
+// HostLimits maps host patterns to numeric limits.
+type HostLimits struct {
+	patterns hostPatterns[int]
+}
+
+// ParseHostLimits parses limits like "*=20, api.example.com=5, *.sms.example.com=1".
+func ParseHostLimits(s string) (HostLimits, error) {
+	patterns, err := parseHostPatterns(s, func(value string) (int, error) {
+		limit, err := strconv.Atoi(value)
+		if err == nil && limit <= 0 {
+			err = fmt.Errorf("limit must be positive")
+		}
+		return limit, err
+	})
+	return HostLimits{patterns: patterns}, err
+}
+
+// Get returns the limit of the most specific pattern matching the host, 0 if there is none.
+func (l HostLimits) Get(host string) int {
+	limit, _ := l.patterns.get(host)
+	return limit
+}
+
+// Empty reports whether no host is limited.
+func (l HostLimits) Empty() bool {
+	return l.patterns.empty()
+}
+
+// HostConcurrencyKey limits amount of simultaneous requests to the same host.
+func HostConcurrencyKey(limits HostLimits) func(data any) (string, int) {
+	return func(data any) (string, int) {
+		host := hostOf(data.(*requestData).url)
+		return host, limits.Get(host)
+	}
+}
+
+// hostOf returns the lowercase host of the url without the port.
+func hostOf(url string) string {
+	if _, rest, ok := strings.Cut(url, "://"); ok {
+		url = rest
+	}
+	if i := strings.IndexAny(url, "/?#"); i >= 0 {
+		url = url[:i]
+	}
+	if i := strings.LastIndexByte(url, '@'); i >= 0 {
+		url = url[i+1:]
+	}
+	if strings.HasPrefix(url, "[") {
+		// IPv6 address
+		if i := strings.IndexByte(url, ']'); i >= 0 {
+			return url[1:i]
+		}
+	} else if i := strings.LastIndexByte(url, ':'); i >= 0 {
+		url = url[:i]
+	}
+	return strings.ToLower(url)
+}
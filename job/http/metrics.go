@@ -15,16 +15,24 @@ var (
 	m5xx         = metrics.NewCounter(`http_status{code="5xx"}`)
 	mTimeouts    = metrics.NewCounter(`http_timeouts`)
 	mErrors      = metrics.NewCounter(`http_error`)
+	mRetries     = metrics.NewCounter(`http_retries`)
 )
 
 type byHostMetric struct {
 	name  string
+	label string
 	cache *ttlcache.Cache
 }
 
 func newByHostMetric(name string) *byHostMetric {
+	return newByKeyMetric(name, "host")
+}
+
+// newByKeyMetric creates counters with the label, unused counters are removed after an hour.
+func newByKeyMetric(name, label string) *byHostMetric {
 	m := &byHostMetric{
 		name:  name,
+		label: label,
 		cache: ttlcache.NewCache(),
 	}
 	m.cache.SkipTTLExtensionOnHit(false)
@@ -39,7 +47,7 @@ func newByHostMetric(name string) *byHostMetric {
 }
 
 func (m *byHostMetric) getMetricName(host string) string {
-	return m.name + `{host="` + host + `"}`
+	return m.name + `{` + m.label + `="` + host + `"}`
 }
 
 func (m *byHostMetric) inc(host string) {
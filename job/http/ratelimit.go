@@ -0,0 +1,142 @@
+package http
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const bucketsCleanupInterval = time.Minute
+
+type rate struct {
+	perSecond float64
+	burst     float64
+}
+
+// parseRate parses rates like "10/s", "600/m" or "1000/h" with an optional burst like "10/s:20".
+// The burst is the numerator of the rate by default.
+func parseRate(s string) (rate, error) {
+	s, burstStr, hasBurst := strings.Cut(s, ":")
+	countStr, unit, _ := strings.Cut(s, "/")
+	count, err := strconv.ParseFloat(countStr, 64)
+	if err != nil || count <= 0 {
+		return rate{}, errors.New("invalid rate " + s)
+	}
+	var period time.Duration
+	switch unit {
+	case "", "s":
+		period = time.Second
+	case "m":
+		period = time.Minute
+	case "h":
+		period = time.Hour
+	default:
+		if period, err = time.ParseDuration(unit); err != nil || period <= 0 {
+			return rate{}, errors.New("invalid rate period " + unit)
+		}
+	}
+	r := rate{
+		perSecond: count / period.Seconds(),
+		burst:     count,
+	}
+	if hasBurst {
+		if r.burst, err = strconv.ParseFloat(burstStr, 64); err != nil || r.burst < 1 {
+			return rate{}, errors.New("invalid burst " + burstStr)
+		}
+	}
+	if r.burst < 1 {
+		r.burst = 1
+	}
+	return r, nil
+}
+
+// RateLimiter limits requests per host or per the rateLimitKey of the request using token buckets.
+// Throttled requests are postponed until their token is available.
+type RateLimiter struct {
+	limits    hostPatterns[rate]
+	throttled *byHostMetric
+
+	mu          sync.Mutex
+	buckets     map[string]*bucket
+	lastCleanup time.Time
+}
+
+type bucket struct {
+	rate   rate
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter parses limits like "api.example.com=10/s, *.sms.example.com=100/m:5, my-key=1/s".
+// Patterns are matched against the rateLimitKey of the request if it is set, otherwise against the host.
+// It returns nil if there are no limits.
+func NewRateLimiter(limits string) (*RateLimiter, error) {
+	patterns, err := parseHostPatterns(limits, parseRate)
+	if err != nil || patterns.empty() {
+		return nil, err
+	}
+	return &RateLimiter{
+		limits:      patterns,
+		throttled:   newByKeyMetric("http_throttled", "key"),
+		buckets:     make(map[string]*bucket),
+		lastCleanup: time.Now(),
+	}, nil
+}
+
+// reserve takes a token of the key and returns how long to wait until the token is available.
+func (l *RateLimiter) reserve(key string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	r, ok := l.limits.get(key)
+	if !ok {
+		return 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastCleanup) > bucketsCleanupInterval {
+		l.cleanup(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: r.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.rate = r
+	wait := b.take(now)
+	if wait > 0 {
+		l.throttled.inc(key)
+	}
+	return wait
+}
+
+// take removes a token, the amount of tokens becomes negative if requests wait for the future tokens.
+func (b *bucket) take(now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate.perSecond * float64(time.Second))
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate.perSecond
+	if b.tokens > b.rate.burst {
+		b.tokens = b.rate.burst
+	}
+	b.last = now
+}
+
+// cleanup removes full buckets, they are the same as new ones.
+func (l *RateLimiter) cleanup(now time.Time) {
+	for key, b := range l.buckets {
+		if b.refill(now); b.tokens >= b.rate.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastCleanup = now
+}
@@ -0,0 +1,48 @@
+package http
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	checks := map[string]rate{
+		"10/s":    {perSecond: 10, burst: 10},
+		"5":       {perSecond: 5, burst: 5},
+		"120/m:1": {perSecond: 2, burst: 1},
+		"1/10s":   {perSecond: 0.1, burst: 1},
+	}
+	for s, expected := range checks {
+		if r, err := parseRate(s); err != nil || r != expected {
+			t.Errorf("Rate %s is parsed as %v (%v), must be %v", s, r, err, expected)
+		}
+	}
+	for _, s := range []string{"", "0/s", "10/d", "10/s:0"} {
+		if _, err := parseRate(s); err == nil {
+			t.Errorf("Rate %q must be invalid", s)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l, err := NewRateLimiter("example.com=2/s, sms=1/m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.reserve("example.com") != 0 || l.reserve("example.com") != 0 {
+		t.Fatal("Burst must not be throttled")
+	}
+	if wait := l.reserve("example.com"); wait < 400*time.Millisecond || wait > 500*time.Millisecond {
+		t.Errorf("Third request must wait for 0.5s, got %v", wait)
+	}
+	if wait := l.reserve("example.com"); wait < 900*time.Millisecond || wait > time.Second {
+		t.Errorf("Fourth request must wait for 1s, got %v", wait)
+	}
+	if l.reserve("example.org") != 0 {
+		t.Error("Unknown key must not be limited")
+	}
+	l.reserve("sms")
+	if wait := l.reserve("sms"); wait < 59*time.Second {
+		t.Errorf("Second sms must wait for a minute, got %v", wait)
+	}
+}
@@ -0,0 +1,91 @@
+package http
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+
+	"github.com/andybalholm/brotli"
+	"github.com/valyala/fasthttp"
+)
+
+// capturedResponse is the response kept for the callback or the result store.
+type capturedResponse struct {
+	headers map[string]string
+	// Decompressed body
+	body      []byte
+	truncated bool
+}
+
+// captureResponse copies headers and the decompressed body of the response. If all is false,
+// only headers from names are copied. The body is truncated to bodyLimit.
+func captureResponse(res *fasthttp.Response, all bool, names []string, bodyLimit int) *capturedResponse {
+	c := &capturedResponse{
+		headers: make(map[string]string),
+	}
+	encoding := string(res.Header.ContentEncoding())
+	decompress := encoding == "gzip" || encoding == "deflate" || encoding == "br"
+	if all {
+		res.Header.VisitAll(func(key, value []byte) {
+			c.headers[string(key)] = string(value)
+		})
+		if decompress {
+			delete(c.headers, fasthttp.HeaderContentEncoding)
+			delete(c.headers, fasthttp.HeaderContentLength)
+		}
+	} else {
+		for _, name := range names {
+			if value := res.Header.Peek(name); value != nil {
+				c.headers[normalizeHeader(name)] = string(value)
+			}
+		}
+	}
+
+	body := res.Body()
+	if decompress {
+		if decoded, truncated, err := decompressBody(encoding, body, bodyLimit); err == nil {
+			c.body, c.truncated = decoded, truncated
+			return c
+		}
+	}
+	if len(body) > bodyLimit {
+		body = body[:bodyLimit]
+		c.truncated = true
+	}
+	c.body = append([]byte(nil), body...)
+	return c
+}
+
+// decompressBody decompresses at most limit bytes, so compression bombs do not eat the memory.
+func decompressBody(encoding string, body []byte, limit int) ([]byte, bool, error) {
+	var r io.Reader
+	var err error
+	switch encoding {
+	case "gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// Deflate is usually wrapped into zlib, but some servers send it raw
+		if r, err = zlib.NewReader(bytes.NewReader(body)); err != nil {
+			r, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	decoded, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(decoded) > limit {
+		return decoded[:limit], true, nil
+	}
+	return decoded, false, nil
+}
+
+func normalizeHeader(name string) string {
+	return string(fasthttp.AppendNormalizedHeaderKey(nil, name))
+}
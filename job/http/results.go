@@ -0,0 +1,167 @@
+package http
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/xtrafrancyz/bwp/worker"
+)
+
+var (
+	mResultsEvicted = metrics.NewCounter(`http_results_evicted`)
+)
+
+// StoredResult is the response of the finished http job.
+type StoredResult struct {
+	ID         uint64            `json:"id,string"`
+	URL        string            `json:"url"`
+	Method     string            `json:"method"`
+	State      worker.State      `json:"state"`
+	StatusCode int               `json:"statusCode,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	// Decompressed response body, it is base64 encoded in json
+	Body          []byte    `json:"body,omitempty"`
+	BodyTruncated bool      `json:"bodyTruncated,omitempty"`
+	Error         string    `json:"error,omitempty"`
+	ErrorClass    string    `json:"errorClass,omitempty"`
+	Attempts      int       `json:"attempts"`
+	Finished      time.Time `json:"finished"`
+
+	size int
+}
+
+// ResultStore keeps responses of http jobs with storeResponse flag for ttl. The oldest
+// results are evicted when the total size exceeds the limit.
+type ResultStore struct {
+	maxSize   int
+	bodyLimit int
+	ttl       time.Duration
+
+	mu      sync.Mutex
+	results map[uint64]*list.Element
+	order   *list.List
+	size    int
+}
+
+// NewResultStore returns nil if maxSize is not positive.
+func NewResultStore(maxSize, bodyLimit int, ttl time.Duration) *ResultStore {
+	if maxSize <= 0 {
+		return nil
+	}
+	s := &ResultStore{
+		maxSize:   maxSize,
+		bodyLimit: bodyLimit,
+		ttl:       ttl,
+		results:   make(map[uint64]*list.Element),
+		order:     list.New(),
+	}
+	metrics.NewGauge(`http_results`, func() float64 {
+		return float64(s.Len())
+	})
+	metrics.NewGauge(`http_results_size`, func() float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return float64(s.size)
+	})
+	return s
+}
+
+// ResultStoreHook saves results of finished http jobs with storeResponse flag to the store.
+func ResultStoreHook(s *ResultStore) worker.FinishHook {
+	return func(res *worker.JobResult, input any) {
+		data := input.(*requestData)
+		if !data.storeResponse {
+			return
+		}
+		s.add(newStoredResult(res, data, s.bodyLimit))
+	}
+}
+
+// newStoredResult makes the result of the finished job, the body is truncated to bodyLimit.
+func newStoredResult(res *worker.JobResult, data *requestData, bodyLimit int) *StoredResult {
+	r := &StoredResult{
+		ID:         res.ID,
+		URL:        data.url,
+		Method:     data.method,
+		State:      worker.StateSucceeded,
+		StatusCode: data.result.StatusCode,
+		Attempts:   res.Attempts,
+		Finished:   res.Finished,
+	}
+	if res.Err != nil {
+		r.State = worker.StateFailed
+		if res.Err == worker.ErrCancelled {
+			r.State = worker.StateCancelled
+		}
+		r.Error = res.Err.Error()
+		r.ErrorClass = data.result.ErrorClass
+	}
+	if data.response != nil {
+		r.Headers = data.response.headers
+		r.Body = data.response.body
+		r.BodyTruncated = data.response.truncated
+		if len(r.Body) > bodyLimit {
+			r.Body = r.Body[:bodyLimit]
+			r.BodyTruncated = true
+		}
+	}
+	return r
+}
+
+func (s *ResultStore) add(r *StoredResult) {
+	r.size = len(r.URL) + len(r.Body) + len(r.Error) + 128
+	for k, v := range r.Headers {
+		r.size += len(k) + len(v)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The job may finish again after it was interrupted and replayed, the old result is replaced
+	if e, ok := s.results[r.ID]; ok {
+		s.remove(e)
+	}
+	if r.size > s.maxSize {
+		mResultsEvicted.Inc()
+		return
+	}
+	s.results[r.ID] = s.order.PushBack(r)
+	s.size += r.size
+	for s.size > s.maxSize {
+		s.remove(s.order.Front())
+		mResultsEvicted.Inc()
+	}
+}
+
+// Get returns the result of the job if it is not expired.
+func (s *ResultStore) Get(id uint64) (*StoredResult, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	e, ok := s.results[id]
+	if !ok {
+		return nil, false
+	}
+	return e.Value.(*StoredResult), true
+}
+
+func (s *ResultStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	return len(s.results)
+}
+
+// expire removes expired results, they are ordered by the time of finish.
+func (s *ResultStore) expire() {
+	deadline := time.Now().Add(-s.ttl)
+	for e := s.order.Front(); e != nil && e.Value.(*StoredResult).Finished.Before(deadline); e = s.order.Front() {
+		s.remove(e)
+	}
+}
+
+func (s *ResultStore) remove(e *list.Element) {
+	r := s.order.Remove(e).(*StoredResult)
+	delete(s.results, r.ID)
+	s.size -= r.size
+}
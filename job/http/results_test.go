@@ -0,0 +1,60 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestResultStore(t *testing.T) {
+	s := NewResultStore(1000, 100, time.Minute)
+	for i := 1; i <= 5; i++ {
+		s.add(&StoredResult{ID: uint64(i), Body: make([]byte, 200), Finished: time.Now()})
+	}
+	if _, ok := s.Get(1); ok {
+		t.Error("The oldest result must be evicted")
+	}
+	if _, ok := s.Get(5); !ok {
+		t.Error("The newest result must be kept")
+	}
+
+	// The result of the same job is replaced and counted once
+	s.add(&StoredResult{ID: 5, Error: "failed", Finished: time.Now()})
+	if r, ok := s.Get(5); !ok || r.Error != "failed" || len(r.Body) != 0 {
+		t.Errorf("The result must be replaced, got %+v", r)
+	}
+	if s.order.Len() != s.Len() || s.size != 2*(200+128)+128+len("failed") {
+		t.Errorf("The old result must be removed, got %d elements for %d results of size %d", s.order.Len(), s.Len(), s.size)
+	}
+
+	s.ttl = 10 * time.Millisecond
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := s.Get(5); ok || s.Len() != 0 {
+		t.Error("Expired results must be removed")
+	}
+}
+
+func TestDecompressBody(t *testing.T) {
+	original := bytes.Repeat([]byte("hello "), 100)
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	_, _ = w.Write(original)
+	_ = w.Close()
+	body, truncated, err := decompressBody("gzip", gz.Bytes(), 1000)
+	if err != nil || truncated || !bytes.Equal(body, original) {
+		t.Errorf("Invalid gzip body: %v", err)
+	}
+
+	var br bytes.Buffer
+	bw := brotli.NewWriter(&br)
+	_, _ = bw.Write(original)
+	_ = bw.Close()
+	body, truncated, err = decompressBody("br", br.Bytes(), 10)
+	if err != nil || !truncated || !bytes.Equal(body, original[:10]) {
+		t.Errorf("Invalid truncated brotli body: %v", err)
+	}
+}
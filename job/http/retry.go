@@ -0,0 +1,232 @@
+package http
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/json-iterator/go"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	errorClassTimeout = "timeout"
+	errorClassDial    = "dial"
+	errorClassNetwork = "network"
+	errorClassCircuit = "circuit"
+	// Unexpected response status, it is retried by the status code
+	errorClassStatus = "status"
+)
+
+// RetryPolicy describes when and how failed requests are retried.
+type RetryPolicy struct {
+	// Max amount of attempts including the first one
+	Attempts int
+	// Delay before the second attempt, every next delay is doubled
+	Delay time.Duration
+	// Max delay between attempts, also limits the Retry-After header
+	MaxDelay time.Duration
+	// Random part of the delay, from 0 to 1. Negative value means unset in the request policy.
+	Jitter float64
+	// Response status codes which are retried
+	Statuses []int
+	// Classes of errors which are retried: timeout, dial, network, circuit
+	Errors []string
+}
+
+// ParseStatuses parses comma separated status codes.
+func ParseStatuses(str string) ([]int, error) {
+	statuses := make([]int, 0, 4)
+	for _, s := range strings.Split(str, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		code, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, errors.New("invalid status code " + s)
+		}
+		statuses = append(statuses, code)
+	}
+	return statuses, nil
+}
+
+// ParseErrorClasses parses comma separated error classes.
+func ParseErrorClasses(str string) ([]string, error) {
+	classes := make([]string, 0, 3)
+	for _, s := range strings.Split(str, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if s != errorClassTimeout && s != errorClassDial && s != errorClassNetwork && s != errorClassCircuit {
+			return nil, errors.New("invalid error class " + s)
+		}
+		classes = append(classes, s)
+	}
+	return classes, nil
+}
+
+// merge returns the default policy overridden by the set fields of the request policy.
+func (p RetryPolicy) merge(o *RetryPolicy) RetryPolicy {
+	if o == nil {
+		return p
+	}
+	if o.Attempts > 0 {
+		p.Attempts = o.Attempts
+	}
+	if o.Delay > 0 {
+		p.Delay = o.Delay
+	}
+	if o.MaxDelay > 0 {
+		p.MaxDelay = o.MaxDelay
+	}
+	if o.Jitter >= 0 {
+		p.Jitter = o.Jitter
+	}
+	if o.Statuses != nil {
+		p.Statuses = o.Statuses
+	}
+	if o.Errors != nil {
+		p.Errors = o.Errors
+	}
+	return p
+}
+
+func (p *RetryPolicy) retryableStatus(code int) bool {
+	for _, s := range p.Statuses {
+		if s == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RetryPolicy) retryableError(class string) bool {
+	for _, c := range p.Errors {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay after the attempt, the first attempt is 1.
+func (p *RetryPolicy) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	delay := retryAfter
+	if delay <= 0 {
+		delay = time.Duration(float64(p.Delay) * math.Pow(2, float64(attempt-1)))
+		if p.Jitter > 0 {
+			delay -= time.Duration(rand.Float64() * p.Jitter * float64(delay))
+		}
+	}
+	if p.MaxDelay > 0 && (delay > p.MaxDelay || delay < 0) {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+func classifyError(err error) string {
+	if err == fasthttp.ErrTimeout || err == fasthttp.ErrDialTimeout {
+		return errorClassTimeout
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return errorClassDial
+	}
+	var circuitErr *circuitOpenError
+	if errors.As(err, &circuitErr) {
+		return errorClassCircuit
+	}
+	return errorClassNetwork
+}
+
+// parseRetryAfter parses the Retry-After header, which contains either seconds or a http date.
+func parseRetryAfter(value []byte) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(string(value)); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := fasthttp.ParseHTTPDate(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+func unmarshalRetryPolicy(iter *jsoniter.Iterator) (*RetryPolicy, error) {
+	p := &RetryPolicy{Jitter: -1}
+	var err error
+	for field := iter.ReadObject(); field != ""; field = iter.ReadObject() {
+		switch field {
+		case "attempts":
+			p.Attempts = iter.ReadInt()
+		case "delay":
+			if p.Delay, err = time.ParseDuration(iter.ReadString()); err != nil {
+				return nil, errors.New("invalid request, retry.delay must be a duration")
+			}
+		case "maxDelay":
+			if p.MaxDelay, err = time.ParseDuration(iter.ReadString()); err != nil {
+				return nil, errors.New("invalid request, retry.maxDelay must be a duration")
+			}
+		case "jitter":
+			p.Jitter = iter.ReadFloat64()
+			if p.Jitter < 0 || p.Jitter > 1 {
+				return nil, errors.New("invalid request, retry.jitter must be from 0 to 1")
+			}
+		case "statuses":
+			p.Statuses = make([]int, 0, 4)
+			for iter.ReadArray() {
+				p.Statuses = append(p.Statuses, iter.ReadInt())
+			}
+		case "errors":
+			p.Errors = make([]string, 0, 3)
+			for iter.ReadArray() {
+				p.Errors = append(p.Errors, iter.ReadString())
+			}
+			if _, err = ParseErrorClasses(strings.Join(p.Errors, ",")); err != nil {
+				return nil, errors.New("invalid request, retry.errors: " + err.Error())
+			}
+		default:
+			iter.Skip()
+		}
+	}
+	return p, nil
+}
+
+func marshalRetryPolicy(stream *jsoniter.Stream, p *RetryPolicy) {
+	stream.WriteObjectStart()
+	stream.WriteObjectField("attempts")
+	stream.WriteInt(p.Attempts)
+	if p.Delay > 0 {
+		stream.WriteMore()
+		stream.WriteObjectField("delay")
+		stream.WriteString(p.Delay.String())
+	}
+	if p.MaxDelay > 0 {
+		stream.WriteMore()
+		stream.WriteObjectField("maxDelay")
+		stream.WriteString(p.MaxDelay.String())
+	}
+	if p.Jitter >= 0 {
+		stream.WriteMore()
+		stream.WriteObjectField("jitter")
+		stream.WriteFloat64(p.Jitter)
+	}
+	if p.Statuses != nil {
+		stream.WriteMore()
+		stream.WriteObjectField("statuses")
+		stream.WriteVal(p.Statuses)
+	}
+	if p.Errors != nil {
+		stream.WriteMore()
+		stream.WriteObjectField("errors")
+		stream.WriteVal(p.Errors)
+	}
+	stream.WriteObjectEnd()
+}
@@ -0,0 +1,51 @@
+package http
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{
+		Delay:    time.Second,
+		MaxDelay: 5 * time.Second,
+	}
+	checkBackoff(t, p.backoff(1, 0), time.Second)
+	checkBackoff(t, p.backoff(2, 0), 2*time.Second)
+	checkBackoff(t, p.backoff(3, 0), 4*time.Second)
+	checkBackoff(t, p.backoff(4, 0), 5*time.Second)
+	checkBackoff(t, p.backoff(100, 0), 5*time.Second)
+	checkBackoff(t, p.backoff(1, 3*time.Second), 3*time.Second)
+	checkBackoff(t, p.backoff(1, time.Hour), 5*time.Second)
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.backoff(2, 0); d > 2*time.Second || d < time.Second {
+			t.Errorf("Backoff with jitter %v is out of range", d)
+		}
+	}
+}
+
+func TestMergeRetryPolicy(t *testing.T) {
+	p := RetryPolicy{Attempts: 3, Delay: time.Second, Jitter: 0.2, Statuses: []int{503}}
+	merged := p.merge(&RetryPolicy{Attempts: 5, Jitter: -1, Statuses: []int{}})
+	if merged.Attempts != 5 || merged.Delay != time.Second || merged.Jitter != 0.2 || len(merged.Statuses) != 0 {
+		t.Errorf("Wrong merged policy %+v", merged)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	checkBackoff(t, parseRetryAfter([]byte("120")), 2*time.Minute)
+	checkBackoff(t, parseRetryAfter([]byte("soon")), 0)
+	date := time.Now().Add(time.Hour).UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT")
+	if d := parseRetryAfter([]byte(date)); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("Wrong Retry-After date %v", d)
+	}
+}
+
+func checkBackoff(t *testing.T, actual, expected time.Duration) {
+	t.Helper()
+	if actual != expected {
+		t.Errorf("Wrong delay %v, must be %v", actual, expected)
+	}
+}
@@ -0,0 +1,160 @@
+package http
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/valyala/fasthttp"
+	"github.com/xtrafrancyz/bwp/worker"
+)
+
+var (
+	mWaits        = metrics.NewCounter(`http_waits`)
+	mWaitTimeouts = metrics.NewCounter(`http_wait_timeouts`)
+)
+
+// WaitHook delivers results of finished http jobs to api requests waiting for them.
+// The response body is truncated to bodyLimit.
+func WaitHook(bodyLimit int) worker.FinishHook {
+	return func(res *worker.JobResult, input any) {
+		data := input.(*requestData)
+		if data.waiter == nil {
+			return
+		}
+		// The channel is buffered, so the worker is never blocked by the api request
+		select {
+		case data.waiter <- newStoredResult(res, data, bodyLimit):
+		default:
+		}
+	}
+}
+
+// Waiter holds api requests with the wait query argument until their http jobs are finished.
+type Waiter struct {
+	pool    *worker.Pool
+	maxWait time.Duration
+}
+
+func NewWaiter(pool *worker.Pool, opts Options) *Waiter {
+	return &Waiter{pool: pool, maxWait: opts.MaxWait}
+}
+
+// Wait is the wait of one api request for results of its jobs.
+type Wait struct {
+	waiter  *Waiter
+	timeout time.Duration
+	// Result channels of every job of every item
+	items [][]chan *StoredResult
+	added []chan *StoredResult
+}
+
+// Parse reads the wait query argument, nil is returned if the request does not wait.
+func (w *Waiter) Parse(args *fasthttp.Args) (*Wait, error) {
+	value := args.Peek("wait")
+	if value == nil {
+		return nil, nil
+	}
+	timeout, ok := parseWait(string(value))
+	if !ok {
+		return nil, errors.New("invalid wait, it must be a duration or seconds")
+	}
+	if w.maxWait <= 0 {
+		return nil, errors.New("waiting for results is disabled")
+	}
+	if timeout > w.maxWait {
+		timeout = w.maxWait
+	}
+	return &Wait{waiter: w, timeout: timeout}, nil
+}
+
+// Watch makes a result channel for every decoded job. It is called before jobs are queued,
+// because jobs may finish before they are added.
+func (wt *Wait) Watch(items [][]worker.NewJob) {
+	wt.items = make([][]chan *StoredResult, len(items))
+	for i, jobs := range items {
+		for _, j := range jobs {
+			waiter := make(chan *StoredResult, 1)
+			j.Data.(*requestData).waiter = waiter
+			wt.items[i] = append(wt.items[i], waiter)
+		}
+	}
+}
+
+// Added marks the item as queued, results are awaited only for queued items.
+func (wt *Wait) Added(item int) {
+	wt.added = append(wt.added, wt.items[item]...)
+}
+
+// Results waits for results of queued jobs and returns them aligned with ids, unfinished jobs
+// are returned with their current state. ok is false if any job is not finished in time.
+func (wt *Wait) Results(ids []uint64) ([]any, bool) {
+	results, ok := waitResults(wt.added, wt.timeout)
+	out := make([]any, len(ids))
+	for i, id := range ids {
+		if results[i] != nil {
+			out[i] = results[i]
+			continue
+		}
+		state := worker.StateQueued
+		if status, found := wt.waiter.pool.GetJobStatus(id); found {
+			state = status.State
+		}
+		out[i] = pendingResult{ID: id, State: state}
+	}
+	return out, ok
+}
+
+// pendingResult is the result of the job which is not finished in time.
+type pendingResult struct {
+	ID    uint64       `json:"id,string"`
+	State worker.State `json:"state"`
+}
+
+// parseWait parses the wait query argument, a duration like "5s" or a number of seconds.
+func parseWait(value string) (time.Duration, bool) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return d, d > 0
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds <= 0 {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// waitResults waits for results of submitted jobs. Results of jobs which are not finished
+// in time are nil, ok is false in that case.
+func waitResults(waiters []chan *StoredResult, wait time.Duration) ([]*StoredResult, bool) {
+	mWaits.Inc()
+	results := make([]*StoredResult, len(waiters))
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	expired := false
+	for i, ch := range waiters {
+		if expired {
+			select {
+			case results[i] = <-ch:
+			default:
+			}
+			continue
+		}
+		select {
+		case results[i] = <-ch:
+		case <-timer.C:
+			expired = true
+			select {
+			case results[i] = <-ch:
+			default:
+			}
+		}
+	}
+	for _, r := range results {
+		if r == nil {
+			mWaitTimeouts.Inc()
+			return results, false
+		}
+	}
+	return results, true
+}
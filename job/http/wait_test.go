@@ -0,0 +1,43 @@
+package http
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWait(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		wait  time.Duration
+		ok    bool
+	}{
+		{"5s", 5 * time.Second, true},
+		{"1.5", 1500 * time.Millisecond, true},
+		{"0", 0, false},
+		{"-1s", 0, false},
+		{"soon", 0, false},
+	} {
+		wait, ok := parseWait(c.value)
+		if ok != c.ok || (ok && wait != c.wait) {
+			t.Errorf("parseWait(%q) = %v, %v", c.value, wait, ok)
+		}
+	}
+}
+
+func TestWaitResults(t *testing.T) {
+	waiters := []chan *StoredResult{make(chan *StoredResult, 1), make(chan *StoredResult, 1)}
+	waiters[0] <- &StoredResult{ID: 1}
+	results, ok := waitResults(waiters, 10*time.Millisecond)
+	if ok || results[0] == nil || results[1] != nil {
+		t.Error("Only the first job must be finished")
+	}
+
+	waiters[0] <- &StoredResult{ID: 1}
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		waiters[1] <- &StoredResult{ID: 2}
+	}()
+	if results, ok = waitResults(waiters, time.Second); !ok || results[1].ID != 2 {
+		t.Error("Both jobs must be finished")
+	}
+}
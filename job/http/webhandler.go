@@ -3,142 +3,134 @@ package http
 import (
 	"encoding/base64"
 	"errors"
+	"strings"
+	"time"
 
 	"github.com/json-iterator/go"
 	"github.com/valyala/bytebufferpool"
-	"github.com/valyala/fasthttp"
 	"github.com/xtrafrancyz/bwp/worker"
 )
 
-type webHandler struct {
-	pool *worker.Pool
-}
-
-func WebHandler(pool *worker.Pool) fasthttp.RequestHandler {
-	return (&webHandler{pool: pool}).handlePostHttp
-}
-
 var (
 	json = jsoniter.ConfigFastest
 )
 
-func (h *webHandler) handlePostHttp(ctx *fasthttp.RequestCtx) {
-	body := ctx.Request.Body()
-	if value := ctx.Request.Header.Peek(fasthttp.HeaderContentEncoding); value != nil {
-		var err error
-		if string(value) == "gzip" {
-			if body, err = ctx.Request.BodyGunzip(); err != nil {
-				ctx.Error(err.Error(), 400)
-				return
-			}
-		} else if string(value) == "deflate" {
-			if body, err = ctx.Request.BodyInflate(); err != nil {
-				ctx.Error(err.Error(), 400)
-				return
-			}
-		}
+// expandClones returns clones of the request which inherit its unset fields,
+// the request itself is released. Requests without clones are returned as is.
+func expandClones(data *requestData) []*requestData {
+	if len(data.clones) == 0 {
+		return []*requestData{data}
 	}
+	defer releaseRequestData(data)
 
-	if body == nil || len(body) < 2 {
-		ctx.Error("Invalid post body", 400)
-		return
-	}
-	fc := body[0]
-	if fc != '[' && fc != '{' {
-		ctx.Error("Invalid json data", 400)
-		return
+	if data.body != nil {
+		*data.bodyReleaseCounter += int32(len(data.clones))
 	}
 
-	iter := json.BorrowIterator(body)
-	defer json.ReturnIterator(iter)
-	if fc == '[' {
-		jobs := make([]*requestData, 0, 4)
-		for iter.ReadArray() {
-			jobData, err := unmarshalRequestData(iter, true)
-			if err != nil {
-				ctx.Error(err.Error(), 400)
-				return
+	for _, c := range data.clones {
+		// Copy parameters
+		if c.parameters != nil {
+			for k, v := range data.parameters {
+				if _, ok := c.parameters[k]; !ok {
+					c.parameters[k] = v
+				}
 			}
-			jobs = append(jobs, jobData)
+		} else {
+			c.parameters = data.parameters
 		}
-		for _, data := range jobs {
-			if err := h.submitJob(data); err != nil {
-				ctx.Error(err.Error(), 503)
-				return
+
+		// Copy headers
+		if c.headers != nil {
+			for k, v := range data.headers {
+				if _, ok := c.headers[k]; !ok {
+					c.headers[k] = v
+				}
 			}
+		} else {
+			c.headers = data.headers
 		}
-	} else {
-		jobData, err := unmarshalRequestData(iter, true)
-		if err != nil {
-			ctx.Error(err.Error(), 400)
-			return
+
+		if c.body == nil {
+			c.body = data.body
+			c.bodyReleaseCounter = data.bodyReleaseCounter
 		}
-		if err = h.submitJob(jobData); err != nil {
-			ctx.Error(err.Error(), 503)
-			return
+
+		if c.url == "" {
+			c.url = data.url
 		}
-	}
 
-	ctx.SetStatusCode(200)
-	ctx.SetContentType("application/json")
-	ctx.SetBodyString(`{"success":true}`)
-}
+		if c.method == "" {
+			c.method = data.method
+		}
 
-func (h *webHandler) submitJob(data *requestData) error {
-	if len(data.clones) > 0 {
-		defer releaseRequestData(data)
+		if data.hostMetrics {
+			c.hostMetrics = true
+		}
 
-		if data.body != nil {
-			*data.bodyReleaseCounter += int32(len(data.clones))
+		if c.retry == nil {
+			c.retry = data.retry
 		}
 
-		for _, c := range data.clones {
-			// Copy parameters
-			if c.parameters != nil {
-				for k, v := range data.parameters {
-					if _, ok := c.parameters[k]; !ok {
-						c.parameters[k] = v
-					}
-				}
-			} else {
-				c.parameters = data.parameters
-			}
+		if c.runAt.IsZero() {
+			c.runAt = data.runAt
+		}
 
-			// Copy headers
-			if c.headers != nil {
-				for k, v := range data.headers {
-					if _, ok := c.headers[k]; !ok {
-						c.headers[k] = v
-					}
-				}
-			} else {
-				c.headers = data.headers
-			}
+		if c.priority == nil {
+			c.priority = data.priority
+		}
 
-			if c.body == nil {
-				c.body = data.body
-				c.bodyReleaseCounter = data.bodyReleaseCounter
-			}
+		if c.timeout == 0 {
+			c.timeout = data.timeout
+		}
 
-			if c.url == "" {
-				c.url = data.url
-			}
+		if c.rateLimitKey == "" {
+			c.rateLimitKey = data.rateLimitKey
+		}
 
-			if c.method == "" {
-				c.method = data.method
-			}
+		if c.orderingKey == "" {
+			c.orderingKey = data.orderingKey
+		}
 
-			if data.hostMetrics {
-				c.hostMetrics = true
-			}
+		if c.tags == nil {
+			c.tags = data.tags
+		}
 
-			if err := h.pool.AddJob("http", c); err != nil {
-				return err
-			}
+		if c.callback == nil {
+			c.callback = data.callback
+		}
+
+		if data.storeResponse {
+			c.storeResponse = true
 		}
-		return nil
+
 	}
-	return h.pool.AddJob("http", data)
+	return data.clones
+}
+
+func jobOptions(data *requestData) []worker.JobOption {
+	var opts []worker.JobOption
+	if !data.runAt.IsZero() {
+		opts = append(opts, worker.RunAt(data.runAt))
+	}
+	if data.priority != nil {
+		opts = append(opts, worker.WithPriority(*data.priority))
+	}
+	if data.timeout > 0 {
+		opts = append(opts, worker.Timeout(data.timeout))
+	}
+	if data.idempotencyKey != "" {
+		opts = append(opts, worker.IdempotencyKey(data.idempotencyKey))
+	}
+	if data.coalesceKey != "" {
+		opts = append(opts, worker.Coalesce(data.coalesceKey, data.coalesceMode, data.coalesceWindow))
+	}
+	if data.orderingKey != "" {
+		opts = append(opts, worker.OrderingKey(data.orderingKey))
+	}
+	if len(data.tags) > 0 {
+		opts = append(opts, worker.Tags(data.tags...))
+	}
+	return opts
 }
 
 func unmarshalRequestData(iter *jsoniter.Iterator, root bool) (*requestData, error) {
@@ -181,6 +173,82 @@ func unmarshalRequestData(iter *jsoniter.Iterator, root bool) (*requestData, err
 			}
 		case "hostMetrics":
 			data.hostMetrics = iter.ReadBool()
+		case "delay":
+			delay, err := readDuration(iter)
+			if err != nil {
+				return nil, errors.New("invalid request, delay must be a duration or seconds")
+			}
+			data.runAt = time.Now().Add(delay)
+		case "runAt":
+			runAt, err := readTime(iter)
+			if err != nil {
+				return nil, errors.New("invalid request, runAt must be a unix timestamp or RFC 3339 time")
+			}
+			data.runAt = runAt
+		case "priority":
+			priority, err := worker.ParsePriority(iter.ReadString())
+			if err != nil {
+				return nil, errors.New("invalid request, priority must be high, normal or low")
+			}
+			data.priority = &priority
+		case "timeout":
+			timeout, err := readDuration(iter)
+			if err != nil || timeout <= 0 {
+				return nil, errors.New("invalid request, timeout must be a duration or seconds")
+			}
+			data.timeout = timeout
+		case "rateLimitKey":
+			data.rateLimitKey = strings.ToLower(iter.ReadString())
+		case "idempotencyKey":
+			data.idempotencyKey = iter.ReadString()
+		case "orderingKey":
+			data.orderingKey = iter.ReadString()
+		case "tags":
+			for iter.ReadArray() {
+				data.tags = append(data.tags, iter.ReadString())
+			}
+		case "coalesceKey":
+			data.coalesceKey = iter.ReadString()
+		case "coalesceMode":
+			mode, err := worker.ParseCoalesceMode(iter.ReadString())
+			if err != nil {
+				return nil, errors.New("invalid request, coalesceMode must be drop or debounce")
+			}
+			data.coalesceMode = mode
+		case "coalesceWindow":
+			window, err := readDuration(iter)
+			if err != nil || window <= 0 {
+				return nil, errors.New("invalid request, coalesceWindow must be a duration or seconds")
+			}
+			data.coalesceWindow = window
+		case "ref":
+			// Refs of array items are read by the pool
+			if root {
+				iter.Skip()
+			} else {
+				data.ref = iter.ReadString()
+			}
+		case "dependsOn":
+			if root {
+				iter.Skip()
+			} else {
+				data.dependsOn = iter.SkipAndReturnBytes()
+			}
+		case "storeResponse":
+			data.storeResponse = iter.ReadBool()
+		case "callback":
+			callback, err := unmarshalCallback(iter)
+			if err != nil {
+				return nil, err
+			}
+			data.callback = callback
+		case "retry":
+			retry, err := unmarshalRetryPolicy(iter)
+			if err != nil {
+				return nil, err
+			}
+			data.retry = retry
+
 		case "clones":
 			if !root {
 				return nil, errors.New("invalid request, clones can exists only on root request")
@@ -195,6 +263,9 @@ func unmarshalRequestData(iter *jsoniter.Iterator, root bool) (*requestData, err
 			}
 		}
 	}
+	if data.coalesceMode == worker.CoalesceDebounce && data.coalesceWindow == 0 {
+		return nil, errors.New("invalid request, coalesceWindow is required in the debounce mode")
+	}
 	if data.url == "" && len(data.clones) == 0 {
 		return nil, errors.New("invalid request, url is not set")
 	}
@@ -203,3 +274,20 @@ func unmarshalRequestData(iter *jsoniter.Iterator, root bool) (*requestData, err
 	}
 	return data, nil
 }
+
+// readDuration reads a duration string like "1m30s" or a number of seconds.
+func readDuration(iter *jsoniter.Iterator) (time.Duration, error) {
+	if iter.WhatIsNext() == jsoniter.NumberValue {
+		return time.Duration(iter.ReadFloat64() * float64(time.Second)), nil
+	}
+	return time.ParseDuration(iter.ReadString())
+}
+
+// readTime reads a unix timestamp in seconds or a RFC 3339 time.
+func readTime(iter *jsoniter.Iterator) (time.Time, error) {
+	if iter.WhatIsNext() == jsoniter.NumberValue {
+		seconds := iter.ReadFloat64()
+		return time.Unix(0, int64(seconds*float64(time.Second))), nil
+	}
+	return time.Parse(time.RFC3339, iter.ReadString())
+}
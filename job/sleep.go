@@ -1,13 +1,95 @@
 package job
 
 import (
+	"context"
+	"errors"
 	"log"
+	"strconv"
 	"time"
+
+	"github.com/json-iterator/go"
+	"github.com/xtrafrancyz/bwp/worker"
 )
 
-func HandleSleep(data any) error {
-	log.Println("Sleeping...")
-	time.Sleep(data.(time.Duration))
-	log.Println("Ready!")
-	return nil
+var json = jsoniter.ConfigFastest
+
+func HandleSleep(ctx context.Context, data any) error {
+	info, _ := worker.GetJobInfo(ctx)
+	log.Printf("Sleeping %s (job %d)...", data.(time.Duration), info.ID)
+	timer := time.NewTimer(data.(time.Duration))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		log.Println("Ready!")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type sleepCodec struct{}
+
+// NewSleepCodec returns the codec of sleep jobs.
+func NewSleepCodec() worker.Codec {
+	return sleepCodec{}
+}
+
+func (sleepCodec) Marshal(data any) ([]byte, error) {
+	return []byte(strconv.Quote(data.(time.Duration).String())), nil
+}
+
+func (sleepCodec) Unmarshal(b []byte) (any, error) {
+	str, err := strconv.Unquote(string(b))
+	if err != nil {
+		return nil, err
+	}
+	return time.ParseDuration(str)
+}
+
+type sleepDecoder struct{}
+
+// NewSleepDecoder returns the decoder of sleep jobs submitted to the web api:
+//
+//	{"duration": "5s", "priority": "low", "idempotencyKey": "nightly-pause"}
+func NewSleepDecoder() worker.Decoder {
+	return sleepDecoder{}
+}
+
+func (sleepDecoder) Decode(b []byte) ([]worker.NewJob, error) {
+	var req struct {
+		Duration       string `json:"duration"`
+		Priority       string `json:"priority"`
+		IdempotencyKey string `json:"idempotencyKey"`
+	}
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, errors.New("invalid request, " + err.Error())
+	}
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil || duration < 0 {
+		return nil, errors.New("invalid request, duration must be a duration")
+	}
+	var opts []worker.JobOption
+	if req.Priority != "" {
+		priority, err := worker.ParsePriority(req.Priority)
+		if err != nil {
+			return nil, errors.New("invalid request, priority must be high, normal or low")
+		}
+		opts = append(opts, worker.WithPriority(priority))
+	}
+	if req.IdempotencyKey != "" {
+		opts = append(opts, worker.IdempotencyKey(req.IdempotencyKey))
+	}
+	return []worker.NewJob{{Data: duration, Options: opts}}, nil
+}
+
+func (sleepDecoder) Schema() []byte {
+	return []byte(`{
+  "type": "object",
+  "properties": {
+    "duration": {"type": "string", "description": "Duration like 1m30s"},
+    "priority": {"enum": ["high", "normal", "low"]},
+    "idempotencyKey": {"type": "string"}
+  },
+  "required": ["duration"]
+}`)
 }
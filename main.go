@@ -4,38 +4,78 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/VictoriaMetrics/metrics"
 	"github.com/facebookarchive/grace/gracenet"
 	"github.com/valyala/fasthttp"
 	"github.com/valyala/fasthttp/pprofhandler"
 	"github.com/vharitonsky/iniflags"
+	"github.com/xtrafrancyz/bwp/cron"
 	"github.com/xtrafrancyz/bwp/iprouter"
 	"github.com/xtrafrancyz/bwp/job"
 	httpJob "github.com/xtrafrancyz/bwp/job/http"
+	"github.com/xtrafrancyz/bwp/wal"
 	"github.com/xtrafrancyz/bwp/worker"
 )
 
 var (
 	// Is the program started from the facebookgo/grace
-	_ = os.Getenv("LISTEN_FDS") != ""
+	inherited = os.Getenv("LISTEN_FDS") != ""
 
 	pidfile = flag.String("pidfile", "", "path to pid file")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 0, "how long to wait for jobs on shutdown before running ones are cancelled, 0 waits for all jobs")
 )
 
 func main() {
 	listen := flag.String("listen", "127.0.0.1:7012", "address to bind web server")
 	poolSize := flag.Int("pool-size", 50, "number of workers")
-	poolQueueSize := flag.Int("pool-queue-size", 10000, "max number of queued jobs")
+	poolConfigFile := flag.String("pool-config", "", "json file with the pool size or autoscaling, it is reloaded on SIGHUP")
+	poolShards := flag.Int("pool-shards", 0, "number of queue shards, workers take jobs from their own shard first, 0 means the number of CPUs")
+	httpInFlight := flag.Int("http-inflight", 5000, "max number of http requests in flight, they do not occupy workers")
+	poolQueueSize := flag.Int("pool-queue-size", 10000, "max number of queued jobs in each priority lane")
+	poolLaneSizes := flag.String("pool-lane-sizes", "", "max number of queued jobs in lanes which differ from pool-queue-size (example: high=1000,low=100000)")
+	poolScheduleSize := flag.Int("pool-schedule-size", 100000, "max number of delayed jobs, retries and jobs waiting for dependencies outside the queue")
+	actionConcurrency := flag.String("action-concurrency", "", "max number of simultaneously running jobs of actions (example: http=40,sleep=1)")
 	ipRoutes := flag.String("ip-routes", "", "custom ip routing (example: 172.16.0.0/12 -> 172.16.1.1, 0.0.0.0/0 -> auto)")
 	log4xxResponses := flag.Bool("log4xxResponses", false, "log http responses with status code >= 400")
+	hostConcurrency := flag.String("http-host-concurrency", "", "max number of simultaneous requests to hosts (example: *=10,api.example.com=2,*.example.org=5)")
+	retryAttempts := flag.Int("http-retry-attempts", 1, "default max number of attempts of http request, 1 disables retries")
+	retryDelay := flag.Duration("http-retry-delay", time.Second, "default delay before the first retry, every next delay is doubled")
+	retryMaxDelay := flag.Duration("http-retry-max-delay", time.Minute, "default max delay between retries")
+	retryJitter := flag.Float64("http-retry-jitter", 0.2, "default random part of retry delay, from 0 to 1")
+	retryStatuses := flag.String("http-retry-statuses", "408,429,500,502,503,504", "default response status codes to retry")
+	retryErrors := flag.String("http-retry-errors", "timeout,dial,network,circuit", "default error classes to retry: timeout, dial, network, circuit")
+	rateLimits := flag.String("http-rate-limits", "", "max rate of requests to hosts or rate limit keys (example: api.example.com=10/s,*.example.org=600/m:20)")
+	callbackBodyLimit := flag.Int("http-callback-body-limit", 64*1024, "max size of the response body sent to the callback")
+	resultsSize := flag.Int("http-results-size", 64*1024*1024, "max total size of responses kept for jobs with storeResponse, 0 disables the result store")
+	resultsBodyLimit := flag.Int("http-results-body-limit", 1024*1024, "max size of a single response body in the result store")
+	resultsTTL := flag.Duration("http-results-ttl", 10*time.Minute, "how long responses are kept in the result store")
+	maxWait := flag.Duration("http-max-wait", time.Minute, "max time the submit request with ?wait can wait for results, 0 disables waiting")
+	waitBodyLimit := flag.Int("http-wait-body-limit", 1024*1024, "max size of the response body returned to the waiting submit request")
+	breakerFailures := flag.Int("http-breaker-failures", 0, "open the circuit of a host after this many consecutive failures, 0 disables circuit breakers")
+	breakerTimeout := flag.Duration("http-breaker-timeout", 30*time.Second, "how long the circuit stays open before the probe request")
 	pprofHost := flag.String("pprof-bind", "", "address to bind pprof handler (like 127.0.0.1:7777)")
+	queueDir := flag.String("queue-dir", "", "directory for the write-ahead log of queued jobs, empty to keep jobs only in memory")
+	queueSegmentSize := flag.Int64("queue-segment-size", 64*1024*1024, "max size of a single queue log segment in bytes")
+	queueFsync := flag.Bool("queue-fsync", false, "fsync the queue log after every write")
+	jobStatusLimit := flag.Int("job-status-limit", 100000, "max number of job statuses to keep, 0 to disable")
+	jobStatusTTL := flag.Duration("job-status-ttl", time.Hour, "how long to keep the job status after the last update")
+	idempotencyWindow := flag.Duration("idempotency-window", time.Hour, "how long idempotency keys of submitted jobs are remembered, 0 disables deduplication")
+	idempotencyLimit := flag.Int("idempotency-limit", 1000000, "max number of remembered idempotency keys")
+	deadLettersLimit := flag.Int("dead-letters-limit", 10000, "max number of failed jobs to keep for inspection and replay, 0 to disable")
+	deadLettersFile := flag.String("dead-letters-file", "", "file to persist failed jobs, empty to keep them only in memory")
+	schedulesFile := flag.String("schedules-file", "", "json file with periodic jobs")
+	handoffSocket := flag.String("handoff-socket", "", "unix socket for handing off queued jobs to the new process on graceful restart")
 
 	iniflags.Parse()
 
@@ -57,6 +97,19 @@ func main() {
 		log.Println("Using routes:", ipRouter)
 	}
 
+	retryPolicy := httpJob.RetryPolicy{
+		Attempts: *retryAttempts,
+		Delay:    *retryDelay,
+		MaxDelay: *retryMaxDelay,
+		Jitter:   *retryJitter,
+	}
+	if retryPolicy.Statuses, err = httpJob.ParseStatuses(*retryStatuses); err != nil {
+		log.Fatalln(err)
+	}
+	if retryPolicy.Errors, err = httpJob.ParseErrorClasses(*retryErrors); err != nil {
+		log.Fatalln(err)
+	}
+
 	if *pidfile != "" {
 		err = writePidFile(*pidfile)
 		if err != nil {
@@ -66,23 +119,144 @@ func main() {
 		}
 	}
 
+	laneSizes, err := worker.ParseLaneSizes(*poolLaneSizes)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	actionLimits, err := parseActionLimits(*actionConcurrency)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	hostLimits, err := httpJob.ParseHostLimits(*hostConcurrency)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	rateLimiter, err := httpJob.NewRateLimiter(*rateLimits)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	pool := &worker.Pool{
-		Size:      *poolSize,
-		QueueSize: *poolQueueSize,
+		Size:              *poolSize,
+		Shards:            *poolShards,
+		QueueSize:         *poolQueueSize,
+		LaneSizes:         laneSizes,
+		ScheduleSize:      *poolScheduleSize,
+		StatusLimit:       *jobStatusLimit,
+		StatusTTL:         *jobStatusTTL,
+		IdempotencyWindow: *idempotencyWindow,
+		IdempotencyLimit:  *idempotencyLimit,
+	}
+	if *queueDir != "" {
+		journal, err := wal.Open(*queueDir, *queueSegmentSize, *queueFsync)
+		if err != nil {
+			log.Fatalf("Could not open queue log: %s", err)
+		}
+		log.Printf("Queue log: %s", *queueDir)
+		pool.Journal = journal
+	}
+	if *deadLettersLimit > 0 {
+		pool.DeadLetters = &worker.DeadLetterQueue{
+			Limit: *deadLettersLimit,
+			Path:  *deadLettersFile,
+		}
+		if err = pool.DeadLetters.Open(); err != nil {
+			log.Fatalf("Could not load dead letters: %s", err)
+		}
 	}
 	pool.Init()
-	pool.RegisterAction("http", httpJob.NewJobHandler(ipRouter, *log4xxResponses))
-	pool.RegisterAction("sleep", job.HandleSleep)
+	httpOpts := httpJob.Options{
+		Log4xxResponses:   *log4xxResponses,
+		Retry:             retryPolicy,
+		Breakers:          httpJob.NewBreakers(*breakerFailures, *breakerTimeout),
+		RateLimiter:       rateLimiter,
+		CallbackBodyLimit: *callbackBodyLimit,
+		Results:           httpJob.NewResultStore(*resultsSize, *resultsBodyLimit, *resultsTTL),
+		MaxWait:           *maxWait,
+		WaitBodyLimit:     *waitBodyLimit,
+		MaxConnsPerHost:   *httpInFlight,
+	}
+	httpActionOpts := []worker.ActionOption{
+		worker.MaxConcurrency(actionLimits["http"]),
+		worker.OnFinish(httpJob.CallbackHook(pool, *callbackBodyLimit)),
+		worker.OnFinish(httpJob.WaitHook(*waitBodyLimit)),
+	}
+	if httpOpts.Results != nil {
+		httpActionOpts = append(httpActionOpts, worker.OnFinish(httpJob.ResultStoreHook(httpOpts.Results)))
+	}
+	if !hostLimits.Empty() {
+		httpActionOpts = append(httpActionOpts, worker.ConcurrencyKey(httpJob.HostConcurrencyKey(hostLimits)))
+	}
+	pool.RegisterAsyncAction("http", httpJob.NewJobHandler(ipRouter, httpOpts), *httpInFlight, httpActionOpts...)
+	pool.RegisterCodec("http", httpJob.NewCodec())
+	pool.RegisterDecoder("http", httpJob.NewDecoder())
+	pool.RegisterAction("sleep", job.HandleSleep, worker.MaxConcurrency(actionLimits["sleep"]))
+	pool.RegisterCodec("sleep", job.NewSleepCodec())
+	pool.RegisterDecoder("sleep", job.NewSleepDecoder())
 	pool.Start()
+	if *poolConfigFile != "" {
+		if err = applyPoolConfig(*poolConfigFile, pool); err != nil {
+			log.Fatalf("Could not apply pool config: %s", err)
+		}
+	}
+
+	var schedules *cron.Cron
+	if *schedulesFile != "" {
+		entries, err := cron.Load(*schedulesFile)
+		if err != nil {
+			log.Fatalf("Could not load schedules: %s", err)
+		}
+		if schedules, err = cron.New(pool, entries); err != nil {
+			log.Fatalf("Invalid schedules: %s", err)
+		}
+		schedules.Start()
+		log.Printf("Loaded %d schedules from %s", len(entries), *schedulesFile)
+	}
 
 	metrics.NewGauge(`queue_size`, func() float64 {
 		return float64(pool.GetQueueLength())
 	})
+	for _, priority := range worker.Priorities {
+		priority := priority
+		metrics.NewGauge(`lane_queue_size{lane="`+priority.String()+`"}`, func() float64 {
+			return float64(pool.GetLaneLength(priority))
+		})
+	}
+	metrics.NewGauge(`scheduled_jobs`, func() float64 {
+		return float64(pool.GetScheduledJobs())
+	})
+	metrics.NewGauge(`ordered_jobs`, func() float64 {
+		return float64(pool.GetOrderedJobs())
+	})
+	metrics.NewGauge(`waiting_jobs`, func() float64 {
+		return float64(pool.GetWaitingJobs())
+	})
 	metrics.NewGauge(`busy_workers`, func() float64 {
 		return float64(pool.GetActiveWorkers())
 	})
+	metrics.NewGauge(`pool_size`, func() float64 {
+		return float64(pool.GetSize())
+	})
+	metrics.NewGauge(`pool_queue_wait_seconds`, func() float64 {
+		if decisions := pool.GetScaleDecisions(); len(decisions) > 0 {
+			return decisions[len(decisions)-1].QueueWait
+		}
+		return 0
+	})
+	metrics.NewGauge(`pool_utilisation`, func() float64 {
+		if decisions := pool.GetScaleDecisions(); len(decisions) > 0 {
+			return decisions[len(decisions)-1].Utilisation
+		}
+		return 0
+	})
+	metrics.NewGauge(`running_jobs`, func() float64 {
+		return float64(pool.GetRunningJobs())
+	})
+	metrics.NewGauge(`inflight_jobs`, func() float64 {
+		return float64(pool.GetInFlightJobs())
+	})
 
-	ws := NewWebServer(pool)
+	ws := NewWebServer(pool, httpOpts)
 	gnet := &gracenet.Net{}
 
 	for _, host := range strings.Split(*listen, ",") {
@@ -94,13 +268,23 @@ func main() {
 		}(strings.TrimSpace(host))
 	}
 
-	waitForSignals(ws, pool, gnet)
+	var handoffLn *net.UnixListener
+	if *handoffSocket != "" {
+		handoffLn, err = listenHandoff(gnet, *handoffSocket, pool)
+		if err != nil {
+			log.Fatalf("Could not listen handoff socket %s: %s", *handoffSocket, err)
+		}
+	}
+
+	waitForSignals(ws, pool, schedules, gnet, handoffLn, *poolConfigFile)
 }
 
-func waitForSignals(ws *WebServer, pool *worker.Pool, gnet *gracenet.Net) {
+func waitForSignals(ws *WebServer, pool *worker.Pool, schedules *cron.Cron, gnet *gracenet.Net, handoffLn *net.UnixListener, poolConfigFile string) {
 	stopChan := make(chan os.Signal, 2)
 	reloadChan := make(chan os.Signal, 1)
+	configChan := make(chan os.Signal, 1)
 	signal.Notify(stopChan, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(configChan, syscall.SIGHUP)
 	if runtime.GOOS == "linux" {
 		signal.Notify(reloadChan, syscall.Signal(12)) // SIGUSR2
 	}
@@ -115,13 +299,26 @@ func waitForSignals(ws *WebServer, pool *worker.Pool, gnet *gracenet.Net) {
 			shutdown = true
 			go func() {
 				ws.Finish()
-				pool.Finish()
+				if schedules != nil {
+					schedules.Stop()
+				}
+				pool.Finish(*shutdownTimeout)
 				log.Println("Bye!")
 				if *pidfile != "" {
 					_ = os.Remove(*pidfile)
 				}
 				os.Exit(0)
 			}()
+		case <-configChan:
+			if poolConfigFile == "" {
+				log.Println("Pool config file is not set, nothing to reload")
+				continue
+			}
+			if err := applyPoolConfig(poolConfigFile, pool); err != nil {
+				log.Printf("Could not reload pool config: %s", err.Error())
+				continue
+			}
+			log.Printf("Pool config is reloaded, %d workers", pool.GetSize())
 		case <-reloadChan:
 			log.Println("Graceful restarting process")
 			_, err := gnet.StartProcess()
@@ -131,13 +328,37 @@ func waitForSignals(ws *WebServer, pool *worker.Pool, gnet *gracenet.Net) {
 			}
 			signal.Stop(stopChan)
 			signal.Stop(reloadChan)
-			pool.Finish()
+			if schedules != nil {
+				schedules.Stop()
+			}
+			if handoffLn != nil {
+				handoffJobs(handoffLn, pool)
+			}
+			pool.Finish(*shutdownTimeout)
 			log.Println("Done! Old process is slowly dying...")
 			return
 		}
 	}
 }
 
+// parseActionLimits parses limits like "http=40,sleep=1".
+func parseActionLimits(s string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		action, value, ok := strings.Cut(part, "=")
+		limit, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid action limit %s", part)
+		}
+		limits[strings.TrimSpace(action)] = limit
+	}
+	return limits, nil
+}
+
 func writePidFile(pidfile string) error {
 	if err := os.MkdirAll(filepath.Dir(pidfile), os.FileMode(0755)); err != nil {
 		return err
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/fasthttp/router"
+	"github.com/valyala/fasthttp"
+	"github.com/xtrafrancyz/bwp/worker"
+)
+
+// poolConfig is the part of the pool configuration that can be changed without restart.
+// It is read from the pool config file on start and on SIGHUP, and from the admin api.
+type poolConfig struct {
+	// Fixed amount of workers, it is ignored when autoscale is set
+	Size      int              `json:"size,omitempty"`
+	Autoscale *autoscaleConfig `json:"autoscale,omitempty"`
+}
+
+type autoscaleConfig struct {
+	MinSize         int     `json:"minSize"`
+	MaxSize         int     `json:"maxSize"`
+	TargetWait      string  `json:"targetWait,omitempty"`
+	HighUtilisation float64 `json:"highUtilisation,omitempty"`
+	LowUtilisation  float64 `json:"lowUtilisation,omitempty"`
+	Interval        string  `json:"interval,omitempty"`
+}
+
+func loadPoolConfig(path string) (*poolConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &poolConfig{}
+	if err = json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func applyPoolConfig(path string, pool *worker.Pool) error {
+	c, err := loadPoolConfig(path)
+	if err != nil {
+		return err
+	}
+	return c.apply(pool)
+}
+
+// apply resizes the pool or starts autoscaling. The config without autoscale stops autoscaling.
+func (c *poolConfig) apply(pool *worker.Pool) error {
+	if c.Autoscale == nil {
+		if c.Size <= 0 {
+			return errors.New("size or autoscale must be set")
+		}
+		if err := pool.Autoscale(nil); err != nil {
+			return err
+		}
+		return pool.Resize(c.Size)
+	}
+	autoscale := &worker.AutoscaleConfig{
+		MinSize:         c.Autoscale.MinSize,
+		MaxSize:         c.Autoscale.MaxSize,
+		HighUtilisation: c.Autoscale.HighUtilisation,
+		LowUtilisation:  c.Autoscale.LowUtilisation,
+	}
+	var err error
+	if c.Autoscale.TargetWait != "" {
+		if autoscale.TargetWait, err = time.ParseDuration(c.Autoscale.TargetWait); err != nil {
+			return fmt.Errorf("invalid targetWait: %w", err)
+		}
+	}
+	if c.Autoscale.Interval != "" {
+		if autoscale.Interval, err = time.ParseDuration(c.Autoscale.Interval); err != nil {
+			return fmt.Errorf("invalid interval: %w", err)
+		}
+	}
+	return pool.Autoscale(autoscale)
+}
+
+// currentPoolConfig returns the config of the pool with defaults of autoscaling.
+func currentPoolConfig(pool *worker.Pool) *poolConfig {
+	c := &poolConfig{Size: pool.GetSize()}
+	if autoscale := pool.GetAutoscale(); autoscale != nil {
+		c.Autoscale = &autoscaleConfig{
+			MinSize:         autoscale.MinSize,
+			MaxSize:         autoscale.MaxSize,
+			TargetWait:      autoscale.TargetWait.String(),
+			HighUtilisation: autoscale.HighUtilisation,
+			LowUtilisation:  autoscale.LowUtilisation,
+			Interval:        autoscale.Interval.String(),
+		}
+	}
+	return c
+}
+
+func (ws *WebServer) registerPoolRoutes(r *router.Router) {
+	r.GET("/pool", ws.handleGetPool)
+	r.PUT("/pool", ws.handleConfigurePool)
+}
+
+func (ws *WebServer) handleGetPool(ctx *fasthttp.RequestCtx) {
+	c := currentPoolConfig(ws.pool)
+	writeJson(ctx, map[string]any{
+		"size":      c.Size,
+		"busy":      ws.pool.GetActiveWorkers(),
+		"autoscale": c.Autoscale,
+		"decisions": ws.pool.GetScaleDecisions(),
+	})
+}
+
+func (ws *WebServer) handleConfigurePool(ctx *fasthttp.RequestCtx) {
+	c := &poolConfig{}
+	if err := json.Unmarshal(ctx.PostBody(), c); err != nil {
+		ctx.Error(err.Error(), 400)
+		return
+	}
+	if err := c.apply(ws.pool); err == worker.ErrPoolClosed {
+		ctx.Error(err.Error(), 503)
+		return
+	} else if err != nil {
+		ctx.Error(err.Error(), 400)
+		return
+	}
+	writeJson(ctx, map[string]any{"success": true, "size": ws.pool.GetSize()})
+}
@@ -0,0 +1,95 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	recordAdd  byte = 1
+	recordDone byte = 2
+
+	// crc32 + body length
+	headerSize = 8
+)
+
+var (
+	errCorrupted = errors.New("corrupted record")
+)
+
+type record struct {
+	kind    byte
+	id      uint64
+	action  string
+	payload []byte
+}
+
+// Record layout:
+//
+//	crc32(body) uint32 | len(body) uint32 | kind byte | id uint64 | len(action) uint16 | action | payload
+func appendRecord(buf []byte, kind byte, id uint64, action string, payload []byte) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, headerSize)...)
+	buf = append(buf, kind)
+	buf = binary.LittleEndian.AppendUint64(buf, id)
+	if kind == recordAdd {
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(action)))
+		buf = append(buf, action...)
+		buf = append(buf, payload...)
+	}
+	body := buf[start+headerSize:]
+	binary.LittleEndian.PutUint32(buf[start:], crc32.ChecksumIEEE(body))
+	binary.LittleEndian.PutUint32(buf[start+4:], uint32(len(body)))
+	return buf
+}
+
+// readRecords reads records until EOF. A torn or corrupted tail is reported as an error,
+// all records before it are still passed to fn.
+func readRecords(r io.Reader, fn func(r record)) error {
+	br := bufio.NewReader(r)
+	header := make([]byte, headerSize)
+	var body []byte
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		sum := binary.LittleEndian.Uint32(header)
+		size := binary.LittleEndian.Uint32(header[4:])
+		if size < 9 {
+			return errCorrupted
+		}
+		if cap(body) < int(size) {
+			body = make([]byte, size)
+		}
+		body = body[:size]
+		if _, err := io.ReadFull(br, body); err != nil {
+			return err
+		}
+		if crc32.ChecksumIEEE(body) != sum {
+			return errCorrupted
+		}
+
+		rec := record{
+			kind: body[0],
+			id:   binary.LittleEndian.Uint64(body[1:]),
+		}
+		if rec.kind == recordAdd {
+			if size < 11 {
+				return errCorrupted
+			}
+			actionLen := int(binary.LittleEndian.Uint16(body[9:]))
+			if 11+actionLen > int(size) {
+				return errCorrupted
+			}
+			rec.action = string(body[11 : 11+actionLen])
+			rec.payload = append([]byte(nil), body[11+actionLen:]...)
+		}
+		fn(rec)
+	}
+}
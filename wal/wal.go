@@ -0,0 +1,325 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const segmentExt = ".wal"
+
+var (
+	ErrClosed = errors.New("wal is closed")
+)
+
+// Log is a write-ahead log of queued jobs. Every process writes its own
+// segment files (<owner>-<seq>.wal) and holds a lock on them, so the old and
+// the new process can share the same directory during a graceful restart.
+// Segments left by a dead process are replayed by Recover.
+type Log struct {
+	dir         string
+	segmentSize int64
+	sync        bool
+
+	mu       sync.Mutex
+	closed   bool
+	owner    string
+	seq      int
+	active   *segment
+	sealed   []*segment // oldest first
+	index    map[uint64]*segment
+	writeBuf []byte
+}
+
+type segment struct {
+	path string
+	file *os.File
+	size int64
+	// Amount of added and not done records in this segment
+	live int
+}
+
+// Open creates a new log in the directory. Segment is sealed after it grows over
+// segmentSize bytes. With sync every write is followed by fsync.
+func Open(dir string, segmentSize int64, sync bool) (*Log, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &Log{
+		dir:         dir,
+		segmentSize: segmentSize,
+		sync:        sync,
+		owner:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		index:       make(map[uint64]*segment),
+	}
+	var err error
+	if l.active, err = l.createSegment(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Append writes the add record of the job.
+func (l *Log) Append(id uint64, action string, payload []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	l.writeBuf = appendRecord(l.writeBuf[:0], recordAdd, id, action, payload)
+	if err := l.write(l.writeBuf); err != nil {
+		return err
+	}
+	l.index[id] = l.active
+	l.active.live++
+	return l.maybeRotate()
+}
+
+// Done writes the done record of the job, so it will not be replayed anymore.
+func (l *Log) Done(id uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	seg, ok := l.index[id]
+	if !ok {
+		return nil
+	}
+	delete(l.index, id)
+	seg.live--
+	l.writeBuf = appendRecord(l.writeBuf[:0], recordDone, id, "", nil)
+	if err := l.write(l.writeBuf); err != nil {
+		return err
+	}
+	return l.maybeRotate()
+}
+
+// Recover calls fn for every unfinished job found in segments of dead processes.
+// The segments are removed when all their jobs are passed to fn successfully.
+// fn is called without holding the log lock, so it may Append the job again.
+func (l *Log) Recover(fn func(id uint64, action string, payload []byte) error) error {
+	paths, err := filepath.Glob(filepath.Join(l.dir, "*"+segmentExt))
+	if err != nil {
+		return err
+	}
+	owners := make(map[string][]string)
+	for _, path := range paths {
+		owner, _, ok := parseSegmentName(filepath.Base(path))
+		if !ok || owner == l.owner {
+			continue
+		}
+		owners[owner] = append(owners[owner], path)
+	}
+
+	for owner, paths := range owners {
+		sort.Slice(paths, func(i, j int) bool {
+			_, a, _ := parseSegmentName(filepath.Base(paths[i]))
+			_, b, _ := parseSegmentName(filepath.Base(paths[j]))
+			return a < b
+		})
+		if err = l.recoverOwner(paths, fn); err != nil {
+			return fmt.Errorf("could not recover segments of %s: %w", owner, err)
+		}
+	}
+	return nil
+}
+
+func (l *Log) recoverOwner(paths []string, fn func(id uint64, action string, payload []byte) error) error {
+	files := make([]*os.File, 0, len(paths))
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		if locked, err := tryLock(f); err != nil {
+			return err
+		} else if !locked {
+			// Segments are still owned by an alive process
+			return nil
+		}
+	}
+
+	var order []uint64
+	pending := make(map[uint64]record)
+	for i, f := range files {
+		err := readRecords(f, func(r record) {
+			switch r.kind {
+			case recordAdd:
+				if _, ok := pending[r.id]; !ok {
+					order = append(order, r.id)
+					pending[r.id] = r
+				}
+			case recordDone:
+				delete(pending, r.id)
+			}
+		})
+		if err != nil {
+			log.Printf("wal: %s is truncated: %s", paths[i], err.Error())
+		}
+	}
+
+	for _, id := range order {
+		if r, ok := pending[id]; ok {
+			if err := fn(r.id, r.action, r.payload); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes all segments. Segments without unfinished jobs are removed.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	var lastErr error
+	for _, seg := range append(l.sealed, l.active) {
+		if err := seg.close(len(l.index) == 0); err != nil {
+			lastErr = err
+		}
+	}
+	l.sealed = nil
+	return lastErr
+}
+
+func (l *Log) write(b []byte) error {
+	n, err := l.active.file.Write(b)
+	l.active.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if l.sync {
+		return l.active.file.Sync()
+	}
+	return nil
+}
+
+func (l *Log) maybeRotate() error {
+	if l.active.size < l.segmentSize {
+		return nil
+	}
+	next, err := l.createSegment()
+	if err != nil {
+		return err
+	}
+	l.sealed = append(l.sealed, l.active)
+	l.active = next
+	return l.compact()
+}
+
+// compact removes the oldest segments without unfinished jobs. If there are still
+// more than one sealed segment, live records of the oldest one are moved to the
+// active segment, so a few long-living jobs can not keep the whole log alive.
+// Segments are always removed from the head, otherwise done records of the
+// remaining segments could be lost.
+func (l *Log) compact() error {
+	for len(l.sealed) > 0 {
+		oldest := l.sealed[0]
+		if oldest.live > 0 {
+			if len(l.sealed) == 1 {
+				return nil
+			}
+			if err := l.moveLive(oldest); err != nil {
+				return err
+			}
+		}
+		if err := oldest.close(true); err != nil {
+			return err
+		}
+		l.sealed = l.sealed[1:]
+	}
+	return nil
+}
+
+func (l *Log) moveLive(seg *segment) error {
+	if _, err := seg.file.Seek(0, 0); err != nil {
+		return err
+	}
+	var writeErr error
+	err := readRecords(seg.file, func(r record) {
+		if writeErr != nil || r.kind != recordAdd || l.index[r.id] != seg {
+			return
+		}
+		l.writeBuf = appendRecord(l.writeBuf[:0], recordAdd, r.id, r.action, r.payload)
+		if writeErr = l.write(l.writeBuf); writeErr == nil {
+			l.index[r.id] = l.active
+			l.active.live++
+			seg.live--
+		}
+	})
+	if writeErr != nil {
+		return writeErr
+	}
+	return err
+}
+
+func (l *Log) createSegment() (*segment, error) {
+	l.seq++
+	path := filepath.Join(l.dir, fmt.Sprintf("%s-%06d%s", l.owner, l.seq, segmentExt))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if locked, err := tryLock(f); err != nil || !locked {
+		_ = f.Close()
+		_ = os.Remove(path)
+		if err == nil {
+			err = fmt.Errorf("could not lock %s", path)
+		}
+		return nil, err
+	}
+	return &segment{
+		path: path,
+		file: f,
+	}, nil
+}
+
+func (s *segment) close(remove bool) error {
+	err := s.file.Close()
+	if remove {
+		if err0 := os.Remove(s.path); err0 != nil {
+			err = err0
+		}
+	}
+	return err
+}
+
+func parseSegmentName(name string) (owner string, seq int, ok bool) {
+	if !strings.HasSuffix(name, segmentExt) {
+		return "", 0, false
+	}
+	name = strings.TrimSuffix(name, segmentExt)
+	idx := strings.LastIndexByte(name, '-')
+	if idx <= 0 {
+		return "", 0, false
+	}
+	seq, err := strconv.Atoi(name[idx+1:])
+	if err != nil {
+		return "", 0, false
+	}
+	return name[:idx], seq, true
+}
@@ -0,0 +1,87 @@
+package wal
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+type entry struct {
+	id      uint64
+	action  string
+	payload string
+}
+
+func TestRecover(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, 1024)
+	for i := uint64(1); i <= 3; i++ {
+		appendEntry(t, l, i)
+	}
+	if err := l.Done(2); err != nil {
+		t.Fatal(err)
+	}
+
+	// Segments of the alive process must not be touched
+	checkRecovered(t, openLog(t, dir, 1024))
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkRecovered(t, openLog(t, dir, 1024), 1, 3)
+	// Recovered segments are removed
+	checkRecovered(t, openLog(t, dir, 1024))
+}
+
+func TestCompaction(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, 100)
+	appendEntry(t, l, 1)
+	for i := uint64(2); i < 100; i++ {
+		appendEntry(t, l, i)
+		if err := l.Done(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt)); len(files) > 3 {
+		t.Errorf("Log is not compacted, %d segments", len(files))
+	}
+	_ = l.Close()
+	checkRecovered(t, openLog(t, dir, 100), 1)
+}
+
+func openLog(t *testing.T, dir string, segmentSize int64) *Log {
+	l, err := Open(dir, segmentSize, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func appendEntry(t *testing.T, l *Log, id uint64) {
+	if err := l.Append(id, "test", []byte(fmt.Sprint("payload", id))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkRecovered(t *testing.T, l *Log, ids ...uint64) {
+	t.Helper()
+	var recovered []entry
+	err := l.Recover(func(id uint64, action string, payload []byte) error {
+		recovered = append(recovered, entry{id, action, string(payload)})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recovered) != len(ids) {
+		t.Fatalf("Recovered %v, must be %v", recovered, ids)
+	}
+	for i, id := range ids {
+		expected := entry{id, "test", fmt.Sprint("payload", id)}
+		if recovered[i] != expected {
+			t.Errorf("Recovered %v, must be %v", recovered[i], expected)
+		}
+	}
+	_ = l.Close()
+}
@@ -7,11 +7,13 @@ import (
 	"net"
 	"os"
 	"runtime/debug"
+	"strconv"
 	"time"
 
 	"github.com/VictoriaMetrics/metrics"
 	"github.com/facebookarchive/grace/gracenet"
 	"github.com/fasthttp/router"
+	"github.com/json-iterator/go"
 	"github.com/valyala/fasthttp"
 	httpJob "github.com/xtrafrancyz/bwp/job/http"
 	"github.com/xtrafrancyz/bwp/worker"
@@ -19,17 +21,26 @@ import (
 
 type WebServer struct {
 	pool      *worker.Pool
+	waiter    *httpJob.Waiter
+	breakers  *httpJob.Breakers
+	results   *httpJob.ResultStore
 	server    *fasthttp.Server
 	listeners *list.List
 }
 
 var (
 	requestsIn = metrics.NewCounter("requests_in")
+
+	json = jsoniter.ConfigFastest
 )
 
-func NewWebServer(pool *worker.Pool) *WebServer {
+// NewWebServer creates the web api, httpOpts enable admin endpoints of the http action.
+func NewWebServer(pool *worker.Pool, httpOpts httpJob.Options) *WebServer {
 	ws := &WebServer{
 		pool:      pool,
+		waiter:    httpJob.NewWaiter(pool, httpOpts),
+		breakers:  httpOpts.Breakers,
+		results:   httpOpts.Results,
 		listeners: list.New(),
 	}
 
@@ -38,7 +49,22 @@ func NewWebServer(pool *worker.Pool) *WebServer {
 		log.Println("panic:", val, "\n", string(debug.Stack()))
 		ctx.Error("Internal Server Error", 500)
 	}
-	r.POST("/post/http", httpJob.WebHandler(pool))
+	r.POST("/post/{action}", ws.handlePostAction)
+	r.GET("/actions", ws.handleListActions)
+	r.GET("/jobs/{id}", ws.handleJobStatus)
+	r.DELETE("/jobs/{id}", ws.handleCancelJob)
+	r.DELETE("/jobs", ws.handleCancelJobs)
+	ws.registerPoolRoutes(r)
+	if pool.DeadLetters != nil {
+		ws.registerDeadLetterRoutes(r)
+	}
+	if ws.results != nil {
+		r.GET("/results/{id}", ws.handleResult)
+	}
+	if ws.breakers != nil {
+		r.GET("/breakers", ws.handleListBreakers)
+		r.DELETE("/breakers/{host}", ws.handleResetBreaker)
+	}
 	r.GET("/metrics", ws.handleMetrics)
 
 	handler := func(ctx *fasthttp.RequestCtx) {
@@ -86,8 +112,198 @@ func (ws *WebServer) Finish() {
 	}
 }
 
+func (ws *WebServer) handlePostAction(ctx *fasthttp.RequestCtx) {
+	action := ctx.UserValue("action").(string)
+	decoder := ws.pool.GetDecoder(action)
+	if decoder == nil {
+		ctx.Error("Unknown action", 404)
+		return
+	}
+	// Only http jobs deliver their results to waiting requests
+	var wait *httpJob.Wait
+	if action == "http" {
+		var err error
+		if wait, err = ws.waiter.Parse(ctx.QueryArgs()); err != nil {
+			ctx.Error(err.Error(), 400)
+			return
+		}
+	}
+	body, err := requestBody(ctx)
+	if err != nil {
+		ctx.Error(err.Error(), 400)
+		return
+	}
+	key := string(ctx.Request.Header.Peek("Idempotency-Key"))
+	items, errs, err := worker.DecodeItems(decoder, body, key)
+	if err != nil {
+		ctx.Error(err.Error(), 400)
+		return
+	}
+	if wait != nil {
+		wait.Watch(items)
+	}
+
+	response := map[string]any{"success": true}
+	var ids []uint64
+	if ctx.QueryArgs().GetBool("partial") {
+		results := ws.pool.AddItems(action, items, errs)
+		for i, r := range results {
+			ids = append(ids, r.IDs...)
+			if r.Err == nil && wait != nil {
+				wait.Added(i)
+			}
+		}
+		response["items"] = results
+	} else {
+		// The whole request is rejected if any item is invalid or does not fit into the queue,
+		// so the client can safely retry it
+		var jobs []worker.NewJob
+		for i := range items {
+			if errs[i] != nil {
+				for _, item := range items {
+					worker.ReleaseJobs(item)
+				}
+				ctx.Error(errs[i].Error(), 400)
+				return
+			}
+			jobs = append(jobs, items[i]...)
+		}
+		if ids, err = ws.pool.AddJobs(action, jobs); err != nil {
+			worker.ReleaseJobs(jobs)
+			ctx.Error(err.Error(), 503)
+			return
+		}
+		if wait != nil {
+			for i := range items {
+				wait.Added(i)
+			}
+		}
+	}
+	// Ids are strings, because they do not fit into float64 of javascript
+	strIds := make([]string, len(ids))
+	for i, id := range ids {
+		strIds[i] = strconv.FormatUint(id, 10)
+	}
+	response["ids"] = strIds
+
+	finished := true
+	if wait != nil {
+		response["results"], finished = wait.Results(ids)
+	}
+	writeJson(ctx, response)
+	if !finished && ctx.Response.StatusCode() == 200 {
+		// Some jobs are still in progress, the caller can track them by ids
+		ctx.SetStatusCode(202)
+	}
+}
+
+func (ws *WebServer) handleListActions(ctx *fasthttp.RequestCtx) {
+	writeJson(ctx, ws.pool.GetActions())
+}
+
+func (ws *WebServer) handleJobStatus(ctx *fasthttp.RequestCtx) {
+	id, ok := parseIdParam(ctx)
+	if !ok {
+		return
+	}
+	status, ok := ws.pool.GetJobStatus(id)
+	if !ok {
+		ctx.Error("Job not found", 404)
+		return
+	}
+	writeJson(ctx, status)
+}
+
+func (ws *WebServer) handleCancelJob(ctx *fasthttp.RequestCtx) {
+	id, ok := parseIdParam(ctx)
+	if !ok {
+		return
+	}
+	switch err := ws.pool.Cancel(id); err {
+	case nil:
+		writeJson(ctx, map[string]any{"success": true})
+	case worker.ErrNotFound:
+		ctx.Error("Job not found", 404)
+	default:
+		ctx.Error(err.Error(), 409)
+	}
+}
+
+func (ws *WebServer) handleCancelJobs(ctx *fasthttp.RequestCtx) {
+	tag := string(ctx.QueryArgs().Peek("tag"))
+	if tag == "" {
+		ctx.Error("Tag is not set", 400)
+		return
+	}
+	writeJson(ctx, map[string]any{"success": true, "cancelled": ws.pool.CancelTag(tag)})
+}
+
+func (ws *WebServer) handleResult(ctx *fasthttp.RequestCtx) {
+	id, ok := parseIdParam(ctx)
+	if !ok {
+		return
+	}
+	if result, ok := ws.results.Get(id); ok {
+		writeJson(ctx, result)
+		return
+	}
+	status, ok := ws.pool.GetJobStatus(id)
+	if !ok || status.State.Finished() {
+		ctx.Error("Result not found", 404)
+		return
+	}
+	// The job is not finished yet
+	writeJson(ctx, map[string]any{"id": strconv.FormatUint(status.ID, 10), "state": status.State})
+	ctx.SetStatusCode(202)
+}
+
+func (ws *WebServer) handleListBreakers(ctx *fasthttp.RequestCtx) {
+	writeJson(ctx, ws.breakers.List())
+}
+
+func (ws *WebServer) handleResetBreaker(ctx *fasthttp.RequestCtx) {
+	if !ws.breakers.Reset(ctx.UserValue("host").(string)) {
+		ctx.Error("Circuit not found", 404)
+		return
+	}
+	writeJson(ctx, map[string]any{"success": true})
+}
+
 func (ws *WebServer) handleMetrics(ctx *fasthttp.RequestCtx) {
 	requestsIn.Dec()
 	ctx.SetStatusCode(200)
 	metrics.WritePrometheus(ctx, true)
 }
+
+// requestBody returns the body of the request, decompressing it if needed.
+func requestBody(ctx *fasthttp.RequestCtx) ([]byte, error) {
+	switch string(ctx.Request.Header.Peek(fasthttp.HeaderContentEncoding)) {
+	case "gzip":
+		return ctx.Request.BodyGunzip()
+	case "deflate":
+		return ctx.Request.BodyInflate()
+	}
+	return ctx.Request.Body(), nil
+}
+
+func parseIdParam(ctx *fasthttp.RequestCtx) (uint64, bool) {
+	id, err := strconv.ParseUint(ctx.UserValue("id").(string), 10, 64)
+	if err != nil {
+		ctx.Error("Invalid id", 400)
+		return 0, false
+	}
+	return id, true
+}
+
+func writeJson(ctx *fasthttp.RequestCtx, v any) {
+	stream := json.BorrowStream(ctx)
+	defer json.ReturnStream(stream)
+	stream.WriteVal(v)
+	if stream.Error != nil {
+		ctx.Error(stream.Error.Error(), 500)
+		return
+	}
+	ctx.SetStatusCode(200)
+	ctx.SetContentType("application/json")
+	_ = stream.Flush()
+}
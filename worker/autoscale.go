@@ -0,0 +1,258 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	mScaleUps   = metrics.NewCounter(`pool_scale_decisions{action="up"}`)
+	mScaleDowns = metrics.NewCounter(`pool_scale_decisions{action="down"}`)
+	mScaleHolds = metrics.NewCounter(`pool_scale_decisions{action="hold"}`)
+)
+
+const (
+	// How many recent decisions are kept for GetScaleDecisions
+	scaleHistory = 20
+	// How often utilisation of workers is sampled between decisions
+	utilisationSampleInterval = time.Second
+)
+
+var (
+	errInvalidAutoscale = errors.New("autoscale sizes must be positive and max size must not be less than min size")
+)
+
+// AutoscaleConfig defines the bounds and targets of autoscaling. Zero targets are replaced by defaults.
+type AutoscaleConfig struct {
+	MinSize int
+	MaxSize int
+	// The pool grows while jobs wait in the queue longer on average, 100ms by default
+	TargetWait time.Duration
+	// The pool grows while the share of busy workers is higher, 0.8 by default
+	HighUtilisation float64
+	// The pool shrinks while the share of busy workers is lower and jobs do not wait, 0.3 by default
+	LowUtilisation float64
+	// How often the size is reconsidered, 10s by default
+	Interval time.Duration
+}
+
+// ScaleDecision describes the size chosen by the autoscaler and the measurements behind it.
+type ScaleDecision struct {
+	Time time.Time `json:"time"`
+	From int       `json:"from"`
+	To   int       `json:"to"`
+	// Average wait of jobs taken from the queue during the interval, in seconds
+	QueueWait float64 `json:"queueWait"`
+	// Average share of busy workers during the interval
+	Utilisation float64 `json:"utilisation"`
+	Reason      string  `json:"reason"`
+}
+
+func (c *AutoscaleConfig) withDefaults() (AutoscaleConfig, error) {
+	if c.MinSize < 1 || c.MaxSize < c.MinSize {
+		return AutoscaleConfig{}, errInvalidAutoscale
+	}
+	r := *c
+	if r.TargetWait <= 0 {
+		r.TargetWait = 100 * time.Millisecond
+	}
+	if r.HighUtilisation <= 0 {
+		r.HighUtilisation = 0.8
+	}
+	if r.LowUtilisation <= 0 {
+		r.LowUtilisation = 0.3
+	}
+	if r.Interval <= 0 {
+		r.Interval = 10 * time.Second
+	}
+	return r, nil
+}
+
+// decide returns the new size. The pool grows by a quarter and shrinks by an eighth,
+// so it reacts to load faster than to its absence.
+func (c *AutoscaleConfig) decide(size int, wait time.Duration, utilisation float64) (int, string) {
+	switch {
+	case size < c.MinSize:
+		return c.MinSize, "below min size"
+	case size > c.MaxSize:
+		return c.MaxSize, "above max size"
+	case wait > c.TargetWait || utilisation >= c.HighUtilisation:
+		reason := fmt.Sprintf("queue wait %s above %s", wait.Round(time.Millisecond), c.TargetWait)
+		if wait <= c.TargetWait {
+			reason = fmt.Sprintf("utilisation %.2f above %.2f", utilisation, c.HighUtilisation)
+		}
+		if size == c.MaxSize {
+			return size, reason + ", at max size"
+		}
+		return minInt(c.MaxSize, size+maxInt(1, size/4)), reason
+	case utilisation <= c.LowUtilisation:
+		reason := fmt.Sprintf("utilisation %.2f below %.2f", utilisation, c.LowUtilisation)
+		if size == c.MinSize {
+			return size, reason + ", at min size"
+		}
+		return maxInt(c.MinSize, size-maxInt(1, size/8)), reason
+	}
+	return size, "within targets"
+}
+
+type autoscaler struct {
+	pool   *Pool
+	config AutoscaleConfig
+	stop   chan struct{}
+}
+
+func (a *autoscaler) run() {
+	sample := time.NewTicker(minDuration(utilisationSampleInterval, a.config.Interval))
+	defer sample.Stop()
+	decide := time.NewTicker(a.config.Interval)
+	defer decide.Stop()
+	var busy float64
+	samples := 0
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-sample.C:
+			busy += float64(a.pool.GetActiveWorkers()) / float64(a.pool.GetSize())
+			samples++
+		case <-decide.C:
+			utilisation := busy / float64(maxInt(samples, 1))
+			busy, samples = 0, 0
+			if !a.pool.scale(a, utilisation) {
+				return
+			}
+		}
+	}
+}
+
+// Autoscale resizes the pool between the min and max sizes of the config by the queue wait and
+// utilisation of workers, the previous config is replaced. Nil stops autoscaling and keeps
+// the current size.
+func (p *Pool) Autoscale(config *AutoscaleConfig) error {
+	var c AutoscaleConfig
+	if config != nil {
+		var err error
+		if c, err = config.withDefaults(); err != nil {
+			return err
+		}
+	}
+	p.scaling.Lock()
+	defer p.scaling.Unlock()
+	if p.autoscaler != nil {
+		close(p.autoscaler.stop)
+		p.autoscaler = nil
+	}
+	if config == nil {
+		return nil
+	}
+	if p.finish {
+		return ErrPoolClosed
+	}
+	a := &autoscaler{
+		pool:   p,
+		config: c,
+		stop:   make(chan struct{}),
+	}
+	p.autoscaler = a
+	// Waits of jobs taken before are not related to the new config
+	p.takeQueueWait()
+	if size := p.GetSize(); size < c.MinSize || size > c.MaxSize {
+		p.applyDecision(size, 0, 0)
+	}
+	go a.run()
+	return nil
+}
+
+// scale applies the decision of the autoscaler, it returns false when the autoscaler is replaced.
+func (p *Pool) scale(a *autoscaler, utilisation float64) bool {
+	p.scaling.Lock()
+	defer p.scaling.Unlock()
+	if p.autoscaler != a {
+		return false
+	}
+	p.applyDecision(p.GetSize(), p.takeQueueWait(), utilisation)
+	return true
+}
+
+func (p *Pool) applyDecision(size int, wait time.Duration, utilisation float64) {
+	to, reason := p.autoscaler.config.decide(size, wait, utilisation)
+	if to != size {
+		if err := p.Resize(to); err != nil {
+			return
+		}
+		log.Printf("Pool is resized from %d to %d workers: %s", size, to, reason)
+	}
+	switch {
+	case to > size:
+		mScaleUps.Inc()
+	case to < size:
+		mScaleDowns.Inc()
+	default:
+		mScaleHolds.Inc()
+	}
+	p.decisions = append(p.decisions, ScaleDecision{
+		Time:        time.Now(),
+		From:        size,
+		To:          to,
+		QueueWait:   wait.Seconds(),
+		Utilisation: utilisation,
+		Reason:      reason,
+	})
+	if len(p.decisions) > scaleHistory {
+		p.decisions = p.decisions[len(p.decisions)-scaleHistory:]
+	}
+}
+
+// takeQueueWait returns the average queue wait of jobs taken since the previous call.
+func (p *Pool) takeQueueWait() time.Duration {
+	sum := atomic.SwapInt64(&p.waitSum, 0)
+	count := atomic.SwapInt64(&p.waitCount, 0)
+	if count == 0 {
+		return 0
+	}
+	return time.Duration(sum / count)
+}
+
+// GetAutoscale returns the current autoscale config with defaults or nil if the pool is not autoscaled.
+func (p *Pool) GetAutoscale() *AutoscaleConfig {
+	p.scaling.Lock()
+	defer p.scaling.Unlock()
+	if p.autoscaler == nil {
+		return nil
+	}
+	c := p.autoscaler.config
+	return &c
+}
+
+// GetScaleDecisions returns recent decisions of the autoscaler, the last one is the latest.
+func (p *Pool) GetScaleDecisions() []ScaleDecision {
+	p.scaling.Lock()
+	defer p.scaling.Unlock()
+	return append([]ScaleDecision(nil), p.decisions...)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
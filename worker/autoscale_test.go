@@ -0,0 +1,85 @@
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAutoscaleDecide(t *testing.T) {
+	c, err := (&AutoscaleConfig{MinSize: 2, MaxSize: 10}).withDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to, _ := c.decide(8, time.Second, 0.5); to != 10 {
+		t.Errorf("The pool must grow when jobs wait, got %d", to)
+	}
+	if to, _ := c.decide(4, 0, 0.9); to != 5 {
+		t.Errorf("The pool must grow when workers are busy, got %d", to)
+	}
+	if to, _ := c.decide(4, 0, 0.1); to != 3 {
+		t.Errorf("The pool must shrink when workers are idle, got %d", to)
+	}
+	if to, _ := c.decide(2, 0, 0.1); to != 2 {
+		t.Errorf("The pool must not shrink below the min size, got %d", to)
+	}
+	if to, _ := c.decide(4, 0, 0.5); to != 4 {
+		t.Errorf("The pool must keep its size within targets, got %d", to)
+	}
+	if _, err = (&AutoscaleConfig{MinSize: 5, MaxSize: 2}).withDefaults(); err == nil {
+		t.Error("The max size must not be less than the min size")
+	}
+}
+
+func TestResize(t *testing.T) {
+	p := &Pool{Size: 2, QueueSize: 10, ScheduleSize: 1}
+	p.Init()
+	release := make(chan struct{})
+	p.RegisterAction("test", func(context.Context, any) error {
+		<-release
+		return nil
+	})
+	p.Start()
+
+	if err := p.Resize(4); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		p.AddJob("test", nil)
+	}
+	waitActive(t, p, 4)
+	if err := p.Resize(1); err != nil {
+		t.Fatal(err)
+	}
+	if p.GetSize() != 1 {
+		t.Fatalf("Expected 1 worker, got %d", p.GetSize())
+	}
+	// Retired workers finish their jobs and do not take new ones
+	for i := 0; i < 4; i++ {
+		release <- struct{}{}
+	}
+	waitActive(t, p, 0)
+	for i := 0; i < 3; i++ {
+		p.AddJob("test", nil)
+	}
+	waitActive(t, p, 1)
+	time.Sleep(50 * time.Millisecond)
+	if p.GetActiveWorkers() != 1 || p.GetQueueLength() != 2 {
+		t.Fatalf("Only one worker must take jobs, got %d active and %d queued", p.GetActiveWorkers(), p.GetQueueLength())
+	}
+	close(release)
+	p.Finish(0)
+	if err := p.Resize(2); err != ErrPoolClosed {
+		t.Errorf("The finished pool must not be resized, got %v", err)
+	}
+}
+
+func waitActive(t *testing.T, p *Pool, n int) {
+	deadline := time.Now().Add(time.Second)
+	for p.GetActiveWorkers() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d active workers, got %d", n, p.GetActiveWorkers())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
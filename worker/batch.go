@@ -0,0 +1,331 @@
+package worker
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// What happens to the job of the batch
+const (
+	admitNew = iota
+	// The job has a known idempotency key
+	admitDuplicate
+	// The job is merged into the pending job with the same coalesce key
+	admitCoalesced
+)
+
+// AddJobs puts all jobs of the batch to the pool or none of them. It fails with ErrQueueFull
+// or ErrScheduleFull if there is no room for the whole batch. Jobs with known idempotency keys
+// or coalesced into pending jobs are not queued, ids of the original jobs are returned for them.
+// Jobs may depend on earlier jobs of the batch, see NewJob.DependsOn.
+func (p *Pool) AddJobs(action string, jobs []NewJob) ([]uint64, error) {
+	if p.finish {
+		return nil, ErrPoolClosed
+	}
+	batch := make([]job, len(jobs))
+	now := time.Now()
+	for i, nj := range jobs {
+		j := &batch[i]
+		j.id = atomic.AddUint64(&p.lastID, 1)
+		j.action = action
+		j.data = nj.Data
+		for _, opt := range nj.Options {
+			opt(j)
+		}
+		for _, k := range nj.DependsOn {
+			if k < 0 || k >= i {
+				return nil, ErrInvalidDependency
+			}
+			j.dependsOn = append(j.dependsOn, batch[k].id)
+		}
+		j.queued = now
+	}
+
+	p.admission.Lock()
+	ids, admits, err := p.admit(action, batch, now)
+	if err != nil {
+		p.admission.Unlock()
+		return nil, err
+	}
+	failed := p.place(batch, admits, now)
+	p.admission.Unlock()
+	// Hooks of failed jobs may add jobs, so they run after the admission is unlocked
+	for _, f := range failed {
+		p.dependencyFailed(f.job, f.parent)
+	}
+	return ids, nil
+}
+
+type failedDependent struct {
+	job    job
+	parent uint64
+}
+
+// place puts admitted jobs of the batch to the queue, the scheduler or the dependency tracker.
+// It returns jobs whose parents are already failed.
+func (p *Pool) place(batch []job, admits []int, now time.Time) []failedDependent {
+	// Children are tracked before any job of the batch is queued, so their parents can not finish unnoticed
+	var pending map[uint64]bool
+	held := make([]bool, len(batch))
+	var failed []failedDependent
+	for i := range batch {
+		j := &batch[i]
+		if admits[i] != admitNew || len(j.dependsOn) == 0 {
+			continue
+		}
+		if pending == nil {
+			pending = make(map[uint64]bool, len(batch))
+			for k := range batch {
+				if admits[k] == admitNew {
+					pending[batch[k].id] = true
+				}
+			}
+		}
+		var parent uint64
+		if held[i], parent = p.dependencies.add(*j, pending, p.statuses); parent != 0 {
+			held[i] = true
+			failed = append(failed, failedDependent{job: *j, parent: parent})
+		}
+	}
+	// Nothing below blocks, because the admission is still locked
+	for i, j := range batch {
+		if admits[i] != admitNew {
+			continue
+		}
+		if j.idempotencyKey != "" {
+			p.idempotency.set(j.action, j.idempotencyKey, j.id)
+		}
+		if held[i] {
+			p.statuses.added(&j, StateWaiting)
+			continue
+		}
+		if j.runAt.After(now) {
+			p.statuses.added(&j, StateScheduled)
+			p.scheduler.add(j, j.runAt)
+			continue
+		}
+		p.statuses.added(&j, StateQueued)
+		if len(j.dependsOn) > 0 {
+			// The room is reserved in the schedule, the scheduler moves the job to the queue
+			p.scheduler.add(j, now)
+			continue
+		}
+		// The room is checked by admit, but retries moved by the scheduler can take it meanwhile.
+		// The job which does not fit waits in the scheduler, which moves it to the queue.
+		if !p.jobsQueue.offer(j) {
+			p.scheduler.add(j, now)
+		}
+	}
+	return failed
+}
+
+// admit checks the room for the batch, journals new jobs and merges duplicates and coalesced jobs.
+func (p *Pool) admit(action string, batch []job, now time.Time) ([]uint64, []int, error) {
+	// Pending jobs must not be dispatched until the batch is admitted
+	p.coalescer.mu.Lock()
+	defer p.coalescer.mu.Unlock()
+
+	ids := make([]uint64, len(batch))
+	admits := make([]int, len(batch))
+	var keys map[string]uint64
+	// Jobs of the batch which become pending, by coalesce keys
+	var pending map[string]uint64
+	// Ids of the original jobs by ids of merged jobs
+	var merged map[uint64]uint64
+	var needed [lanesCount]int
+	scheduled := 0
+	for i := range batch {
+		j := &batch[i]
+		ids[i] = j.id
+		if j.idempotencyKey != "" && p.idempotency != nil {
+			if id, ok := p.idempotency.get(action, j.idempotencyKey); ok {
+				ids[i], admits[i] = id, admitDuplicate
+			} else if id, ok = keys[j.idempotencyKey]; ok {
+				ids[i], admits[i] = id, admitDuplicate
+			}
+			if admits[i] != admitNew {
+				merged = mergedInto(merged, j.id, ids[i])
+				continue
+			}
+			if keys == nil {
+				keys = make(map[string]uint64)
+			}
+			keys[j.idempotencyKey] = j.id
+		}
+		if j.coalesceKey != "" {
+			key := action + ":" + j.coalesceKey
+			if pj, ok := p.coalescer.pending[key]; ok {
+				ids[i], admits[i] = pj.id, admitCoalesced
+			} else if id, ok := pending[key]; ok {
+				ids[i], admits[i] = id, admitCoalesced
+			}
+			if admits[i] != admitNew {
+				merged = mergedInto(merged, j.id, ids[i])
+				continue
+			}
+			if pending == nil {
+				pending = make(map[string]uint64)
+			}
+			pending[key] = j.id
+			if j.coalesceMode == CoalesceDebounce && j.runAt.Before(now.Add(j.coalesceWindow)) {
+				j.runAt = now.Add(j.coalesceWindow)
+			}
+		}
+		for k, id := range j.dependsOn {
+			// Children of merged jobs wait for the original jobs
+			if original, ok := merged[id]; ok {
+				j.dependsOn[k] = original
+			}
+		}
+		// Children wait outside the queue
+		if j.runAt.After(now) || len(j.dependsOn) > 0 {
+			scheduled++
+		} else {
+			needed[j.priority.lane()]++
+		}
+	}
+	if scheduled > 0 && p.scheduler.len()+p.dependencies.len()+scheduled > p.ScheduleSize {
+		return nil, nil, ErrScheduleFull
+	}
+	for _, priority := range Priorities {
+		if needed[priority.lane()] > p.jobsQueue.room(priority) {
+			return nil, nil, ErrQueueFull
+		}
+	}
+	for i := range batch {
+		if admits[i] != admitNew {
+			continue
+		}
+		if err := p.journalAppend(&batch[i]); err != nil {
+			for k, j := range batch[:i] {
+				if admits[k] == admitNew {
+					p.journalDone(j)
+				}
+			}
+			return nil, nil, err
+		}
+	}
+
+	for i, j := range batch {
+		switch admits[i] {
+		case admitNew:
+			if j.coalesceKey != "" {
+				p.coalescer.pending[action+":"+j.coalesceKey] = &pendingJob{id: j.id, data: j.data}
+			}
+			p.sequencer.add(&batch[i])
+			p.canceller.add(&batch[i])
+		case admitDuplicate:
+			mDuplicateJobs.Inc()
+			release(j.data)
+		case admitCoalesced:
+			mCoalescedJobs.Inc()
+			pj := p.coalescer.pending[action+":"+j.coalesceKey]
+			if j.coalesceMode != CoalesceDebounce {
+				release(j.data)
+				continue
+			}
+			// The last job inside the window wins
+			if pj.replaced {
+				release(pj.data)
+			}
+			pj.data, pj.replaced = j.data, true
+		}
+	}
+	return ids, admits, nil
+}
+
+func mergedInto(merged map[uint64]uint64, id, original uint64) map[uint64]uint64 {
+	if merged == nil {
+		merged = make(map[uint64]uint64)
+	}
+	merged[id] = original
+	return merged
+}
+
+// ItemResult is the outcome of a single item of the batch admitted in the partial mode.
+type ItemResult struct {
+	IDs []uint64
+	Err error
+}
+
+func (r ItemResult) MarshalJSON() ([]byte, error) {
+	stream := json.BorrowStream(nil)
+	defer json.ReturnStream(stream)
+	stream.WriteObjectStart()
+	stream.WriteObjectField("success")
+	stream.WriteBool(r.Err == nil)
+	stream.WriteMore()
+	if r.Err != nil {
+		stream.WriteObjectField("error")
+		stream.WriteString(r.Err.Error())
+	} else {
+		// Ids are strings, because they do not fit into float64 of javascript
+		stream.WriteObjectField("ids")
+		stream.WriteArrayStart()
+		for i, id := range r.IDs {
+			if i != 0 {
+				stream.WriteMore()
+			}
+			stream.WriteString(strconv.FormatUint(id, 10))
+		}
+		stream.WriteArrayEnd()
+	}
+	stream.WriteObjectEnd()
+	return append([]byte(nil), stream.Buffer()...), stream.Error
+}
+
+// AddItems admits every item separately, jobs of a single item are admitted atomically.
+// Items which failed to decode keep their errors. Jobs of rejected items are released.
+// Indexes in NewJob.DependsOn refer to jobs of all items, items which depend on rejected
+// items are rejected too.
+func (p *Pool) AddItems(action string, items [][]NewJob, errs []error) []ItemResult {
+	results := make([]ItemResult, len(items))
+	// Ids of jobs of all items, zero for jobs of rejected items
+	var ids []uint64
+	for i, jobs := range items {
+		offset := len(ids)
+		ids = append(ids, make([]uint64, len(jobs))...)
+		if errs[i] != nil {
+			results[i].Err = errs[i]
+			continue
+		}
+		if results[i].Err = rebaseDependencies(jobs, ids, offset); results[i].Err == nil {
+			results[i].IDs, results[i].Err = p.AddJobs(action, jobs)
+		}
+		if results[i].Err != nil {
+			ReleaseJobs(jobs)
+			continue
+		}
+		copy(ids[offset:], results[i].IDs)
+	}
+	return results
+}
+
+var errRejectedDependency = errors.New("item depends on a rejected item")
+
+// rebaseDependencies converts dependencies of the item on earlier items to ids, so the item
+// can be added as a separate batch.
+func rebaseDependencies(jobs []NewJob, ids []uint64, offset int) error {
+	for k := range jobs {
+		nj := &jobs[k]
+		var own []int
+		var parents []uint64
+		for _, d := range nj.DependsOn {
+			if d >= offset {
+				own = append(own, d-offset)
+				continue
+			}
+			if d < 0 || ids[d] == 0 {
+				return errRejectedDependency
+			}
+			parents = append(parents, ids[d])
+		}
+		nj.DependsOn = own
+		if len(parents) > 0 {
+			nj.Options = append(nj.Options[:len(nj.Options):len(nj.Options)], DependsOn(parents...))
+		}
+	}
+	return nil
+}
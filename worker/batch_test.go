@@ -0,0 +1,54 @@
+package worker
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAddJobs(t *testing.T) {
+	p := &Pool{Size: 1, QueueSize: 2, ScheduleSize: 1}
+	p.Init()
+
+	batch := []NewJob{{Data: 1}, {Data: 2}, {Data: 3, Options: []JobOption{WithPriority(PriorityHigh)}}}
+	if _, err := p.AddJob("test", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.AddJobs("test", batch); err != ErrQueueFull {
+		t.Fatalf("The batch must not fit into the normal lane, got %v", err)
+	}
+	if p.GetQueueLength() != 1 {
+		t.Fatalf("No job of the rejected batch must be queued, got %d jobs", p.GetQueueLength())
+	}
+
+	ids, err := p.AddJobs("test", batch[1:])
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("The batch must be admitted, got %v", err)
+	}
+	if p.GetLaneLength(PriorityNormal) != 2 || p.GetLaneLength(PriorityHigh) != 1 {
+		t.Error("Jobs must be put to their lanes")
+	}
+
+	delayed := []NewJob{{Data: 4, Options: []JobOption{Delay(time.Hour)}}, {Data: 5, Options: []JobOption{Delay(time.Hour)}}}
+	if _, err = p.AddJobs("test", delayed); err != ErrScheduleFull {
+		t.Fatalf("Delayed jobs must not fit into the scheduler, got %v", err)
+	}
+}
+
+func TestAddItems(t *testing.T) {
+	p := &Pool{Size: 1, QueueSize: 2, ScheduleSize: 1}
+	p.Init()
+
+	invalid := errors.New("invalid")
+	items := [][]NewJob{{{Data: 1}}, nil, {{Data: 2}, {Data: 3}}, {{Data: 4}}}
+	results := p.AddItems("test", items, []error{nil, invalid, nil, nil})
+	if results[0].Err != nil || len(results[0].IDs) != 1 {
+		t.Error("The first item must be admitted")
+	}
+	if results[1].Err != invalid {
+		t.Error("The invalid item must keep its error")
+	}
+	if results[2].Err != ErrQueueFull || results[3].Err != nil {
+		t.Error("Only the item which does not fit must be rejected")
+	}
+}
@@ -0,0 +1,223 @@
+package worker
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	ErrCancelled   = errors.New("job is cancelled")
+	ErrJobFinished = errors.New("job is already finished")
+)
+
+var (
+	mCancelledJobs = metrics.NewCounter("cancelled_jobs")
+	mAbortedJobs   = metrics.NewCounter("aborted_jobs")
+)
+
+// Tags labels the job, the job can be cancelled by any of its tags until it is finished.
+func Tags(tags ...string) JobOption {
+	return func(j *job) {
+		j.tags = append(j.tags, tags...)
+	}
+}
+
+// canceller keeps ids of cancelled jobs until they are finished and ids of admitted jobs by their tags.
+type canceller struct {
+	mu sync.Mutex
+	// Amount of cancelled jobs, so workers check ids without the lock while nothing is cancelled
+	count     int32
+	cancelled map[uint64]struct{}
+	tagged    map[string]map[uint64]struct{}
+}
+
+func newCanceller() *canceller {
+	return &canceller{
+		cancelled: make(map[uint64]struct{}),
+		tagged:    make(map[string]map[uint64]struct{}),
+	}
+}
+
+// add indexes the admitted job by its tags.
+func (c *canceller) add(j *job) {
+	if len(j.tags) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tag := range j.tags {
+		ids, ok := c.tagged[tag]
+		if !ok {
+			ids = make(map[uint64]struct{})
+			c.tagged[tag] = ids
+		}
+		ids[j.id] = struct{}{}
+	}
+}
+
+// done forgets the finished or dropped job, it returns true if the job is cancelled.
+func (c *canceller) done(j *job) bool {
+	if len(j.tags) == 0 && atomic.LoadInt32(&c.count) == 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tag := range j.tags {
+		if ids, ok := c.tagged[tag]; ok {
+			delete(ids, j.id)
+			if len(ids) == 0 {
+				delete(c.tagged, tag)
+			}
+		}
+	}
+	return c.unmarkLocked(j.id)
+}
+
+func (c *canceller) isCancelled(id uint64) bool {
+	if atomic.LoadInt32(&c.count) == 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.cancelled[id]
+	return ok
+}
+
+// tracked returns true if the job is tagged and not finished.
+func (c *canceller) tracked(id uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ids := range c.tagged {
+		if _, ok := ids[id]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// countTag returns the amount of not finished jobs with the tag.
+func (c *canceller) countTag(tag string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.tagged[tag])
+}
+
+func (c *canceller) mark(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.markLocked(id)
+}
+
+// markTag cancels all jobs with the tag and returns ids of the newly cancelled ones.
+func (c *canceller) markTag(tag string) []uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var marked []uint64
+	for id := range c.tagged[tag] {
+		if c.markLocked(id) {
+			marked = append(marked, id)
+		}
+	}
+	return marked
+}
+
+func (c *canceller) markLocked(id uint64) bool {
+	if _, ok := c.cancelled[id]; ok {
+		return false
+	}
+	c.cancelled[id] = struct{}{}
+	atomic.AddInt32(&c.count, 1)
+	return true
+}
+
+func (c *canceller) unmark(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unmarkLocked(id)
+}
+
+func (c *canceller) unmarkLocked(id uint64) bool {
+	if _, ok := c.cancelled[id]; !ok {
+		return false
+	}
+	delete(c.cancelled, id)
+	atomic.AddInt32(&c.count, -1)
+	return true
+}
+
+// Cancel cancels the job which is not finished yet. The job which waits for its time, for a
+// concurrency limit or for the previous job with its ordering key is finished at once, the job
+// in the queue is skipped when it is taken, the context of the running attempt is cancelled.
+// The job is looked up in job statuses, tagged jobs and running jobs are known without statuses too.
+func (p *Pool) Cancel(id uint64) error {
+	if err := p.cancellable(id); err != nil {
+		return err
+	}
+	p.canceller.mark(id)
+	// The job could finish between the check and the mark
+	if err := p.cancellable(id); err != nil {
+		p.canceller.unmark(id)
+		return err
+	}
+	p.abort(id)
+	p.withdraw(id)
+	return nil
+}
+
+// CancelTag cancels all not finished jobs with the tag and returns the amount of them.
+func (p *Pool) CancelTag(tag string) int {
+	ids := p.canceller.markTag(tag)
+	for _, id := range ids {
+		p.abort(id)
+		p.withdraw(id)
+	}
+	return len(ids)
+}
+
+// CountTag returns the amount of not finished jobs with the tag. Unlike job statuses, tags are
+// known for every admitted job until it is finished or dropped.
+func (p *Pool) CountTag(tag string) int {
+	return p.canceller.countTag(tag)
+}
+
+func (p *Pool) cancellable(id uint64) error {
+	if status, ok := p.statuses.get(id); ok {
+		switch status.State {
+		case StateSucceeded, StateFailed, StateCancelled:
+			return ErrJobFinished
+		}
+		return nil
+	}
+	if p.canceller.tracked(id) || p.attempts.has(id) {
+		return nil
+	}
+	return ErrNotFound
+}
+
+// withdraw finishes the cancelled job if it waits in the scheduler, the limiter or the sequencer,
+// so it does not hold its place until its time comes.
+func (p *Pool) withdraw(id uint64) {
+	j, ok := p.scheduler.remove(id)
+	if !ok {
+		j, ok = p.limiter.remove(id)
+	}
+	if !ok {
+		j, ok = p.sequencer.remove(id)
+	}
+	if !ok {
+		return
+	}
+	// Later jobs with the coalesce key must not be merged into the cancelled job
+	p.coalescer.take(&j)
+	p.complete(j, ErrCancelled)
+}
+
+// abort cancels the context of the running attempt of the job.
+func (p *Pool) abort(id uint64) {
+	if p.attempts.cancel(id) {
+		mAbortedJobs.Inc()
+	}
+}
@@ -0,0 +1,167 @@
+package worker
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCancel(t *testing.T) {
+	p := &Pool{Size: 1, QueueSize: 10, ScheduleSize: 1, StatusLimit: 10}
+	p.Init()
+	started := make(chan struct{}, 1)
+	p.RegisterAction("test", func(ctx context.Context, data any) error {
+		started <- struct{}{}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	p.Start()
+
+	running, _ := p.AddJob("test", nil)
+	<-started
+	first, _ := p.AddJob("test", nil, Tags("user:42"))
+	second, _ := p.AddJob("test", nil, Tags("user:42", "news"))
+	untagged, _ := p.AddJob("test", nil)
+
+	if n := p.CancelTag("user:42"); n != 2 {
+		t.Fatalf("Expected 2 cancelled jobs, got %d", n)
+	}
+	if err := p.Cancel(untagged); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Cancel(running); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint64{running, first, second, untagged} {
+		waitState(t, p, id, StateCancelled)
+	}
+	select {
+	case <-started:
+		t.Error("Cancelled jobs must not run")
+	default:
+	}
+	if err := p.Cancel(running); err != ErrJobFinished {
+		t.Errorf("The finished job must not be cancelled, got %v", err)
+	}
+	if err := p.Cancel(1); err != ErrNotFound {
+		t.Errorf("The unknown job must not be cancelled, got %v", err)
+	}
+	if p.CancelTag("news") != 0 || len(p.canceller.tagged) != 0 || p.canceller.count != 0 {
+		t.Error("Finished jobs must be forgotten")
+	}
+}
+
+func TestCancelDelayed(t *testing.T) {
+	p := &Pool{Size: 1, QueueSize: 10, ScheduleSize: 1, StatusLimit: 10}
+	p.Init()
+	p.RegisterAction("test", func(context.Context, any) error {
+		return nil
+	})
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	p.Start()
+
+	delayed, _ := p.AddJob("test", nil, Delay(24*time.Hour))
+	if err := p.Cancel(delayed); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := p.GetJobStatus(delayed); status.State != StateCancelled {
+		t.Fatalf("The delayed job must be cancelled at once, got %s", status.State)
+	}
+	if p.GetScheduledJobs() != 0 {
+		t.Fatalf("The cancelled job must leave the scheduler, got %d scheduled", p.GetScheduledJobs())
+	}
+	// The slot of the schedule is free
+	next, err := p.AddJob("test", nil, Delay(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Cancel(next); err != nil {
+		t.Fatal(err)
+	}
+	p.Finish(0)
+}
+
+func TestCancelLimited(t *testing.T) {
+	p := &Pool{Size: 2, QueueSize: 10, ScheduleSize: 10, StatusLimit: 10}
+	p.Init()
+	release := make(chan struct{})
+	p.RegisterAction("test", func(context.Context, any) error {
+		<-release
+		return nil
+	}, MaxConcurrency(1))
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	p.Start()
+
+	running, _ := p.AddJob("test", nil)
+	waitState(t, p, running, StateRunning)
+	limited, _ := p.AddJob("test", nil)
+	deadline := time.Now().Add(time.Second)
+	for p.GetLimitedJobs() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("The job must wait in the limiter")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.Cancel(limited); err != nil {
+		t.Fatal(err)
+	}
+	if p.GetLimitedJobs() != 0 {
+		t.Fatalf("The cancelled job must leave the limiter, got %d limited", p.GetLimitedJobs())
+	}
+	release <- struct{}{}
+	waitState(t, p, running, StateSucceeded)
+	waitState(t, p, limited, StateCancelled)
+
+	// The slot of the cancelled job is not lost
+	next, _ := p.AddJob("test", nil)
+	waitState(t, p, next, StateRunning)
+	close(release)
+	waitState(t, p, next, StateSucceeded)
+	p.Finish(0)
+}
+
+func waitState(t *testing.T, p *Pool, id uint64, state State) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		status, _ := p.GetJobStatus(id)
+		if status.State == state {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s job %d, got %s", state, id, status.State)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCancelledDependency(t *testing.T) {
+	p := &Pool{Size: 1, QueueSize: 10, ScheduleSize: 10, StatusLimit: 10}
+	p.Init()
+	p.RegisterAction("test", func(context.Context, any) error {
+		return nil
+	})
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	parent, _ := p.AddJob("test", nil, Tags("user:42"))
+	p.CancelTag("user:42")
+	p.Start()
+	waitState(t, p, parent, StateCancelled)
+
+	child, err := p.AddJob("test", nil, DependsOn(parent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, p, child, StateFailed)
+	if p.GetWaitingJobs() != 0 {
+		t.Errorf("The child of the cancelled job must not wait, got %d waiting", p.GetWaitingJobs())
+	}
+	p.Finish(0)
+}
@@ -0,0 +1,87 @@
+package worker
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	mCoalescedJobs = metrics.NewCounter("coalesced_jobs")
+)
+
+// CoalesceMode defines what happens to a new job when a job with the same coalesce key is pending.
+type CoalesceMode int
+
+const (
+	// CoalesceDrop discards the new job
+	CoalesceDrop CoalesceMode = iota
+	// CoalesceDebounce delays the first job for the window, later jobs replace its data
+	CoalesceDebounce
+)
+
+// ParseCoalesceMode parses drop or debounce.
+func ParseCoalesceMode(s string) (CoalesceMode, error) {
+	switch s {
+	case "drop":
+		return CoalesceDrop, nil
+	case "debounce":
+		return CoalesceDebounce, nil
+	}
+	return 0, errors.New("unknown coalesce mode " + s)
+}
+
+// Coalesce merges jobs of the same action with the key while one of them is pending, that is
+// not yet dispatched to a worker. The id of the pending job is returned for merged jobs.
+// In the drop mode new jobs are discarded. In the debounce mode the first job is delayed
+// for the window and the data of the last job inside the window is run, though the journal
+// keeps the data of the first one.
+func Coalesce(key string, mode CoalesceMode, window time.Duration) JobOption {
+	return func(j *job) {
+		j.coalesceKey = key
+		j.coalesceMode = mode
+		j.coalesceWindow = window
+	}
+}
+
+// coalescer keeps pending jobs by their coalesce keys.
+type coalescer struct {
+	mu      sync.Mutex
+	pending map[string]*pendingJob
+}
+
+type pendingJob struct {
+	id   uint64
+	data any
+	// The data is replaced by a later job, the job itself still holds its original data
+	replaced bool
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{
+		pending: make(map[string]*pendingJob),
+	}
+}
+
+// take swaps the data of the dispatched job with the latest one and forgets the key,
+// so the next job with the key becomes pending.
+func (c *coalescer) take(j *job) {
+	if j.coalesceKey == "" {
+		return
+	}
+	key := j.action + ":" + j.coalesceKey
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending, ok := c.pending[key]
+	if !ok || pending.id != j.id {
+		// Retries of the job are not coalesced
+		return
+	}
+	delete(c.pending, key)
+	if pending.replaced {
+		release(j.data)
+		j.data = pending.data
+	}
+}
@@ -0,0 +1,38 @@
+package worker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCoalesce(t *testing.T) {
+	p := &Pool{Size: 1, QueueSize: 10, ScheduleSize: 10}
+	p.Init()
+
+	first, _ := p.AddJob("test", 1, Coalesce("a", CoalesceDrop, 0))
+	if id, _ := p.AddJob("test", 2, Coalesce("a", CoalesceDrop, 0)); id != first {
+		t.Errorf("The job must be dropped in favor of the pending one %d, got %d", first, id)
+	}
+	j, _ := p.jobsQueue.poll()
+	p.coalescer.take(&j)
+	if j.data != 1 {
+		t.Errorf("The pending job must keep its data, got %v", j.data)
+	}
+	if id, _ := p.AddJob("test", 3, Coalesce("a", CoalesceDrop, 0)); id == first {
+		t.Error("The dispatched job must not be pending")
+	}
+
+	first, _ = p.AddJob("test", 4, Coalesce("b", CoalesceDebounce, time.Minute))
+	if id, _ := p.AddJob("test", 5, Coalesce("b", CoalesceDebounce, time.Minute)); id != first {
+		t.Errorf("The job must be merged into the pending one %d, got %d", first, id)
+	}
+	scheduled := p.scheduler.drain()
+	if len(scheduled) != 1 || !scheduled[0].runAt.After(time.Now()) {
+		t.Fatal("The debounced job must be delayed for the window")
+	}
+	j = scheduled[0]
+	p.coalescer.take(&j)
+	if j.id != first || j.data != 5 {
+		t.Errorf("The last data must win, got %v", j.data)
+	}
+}
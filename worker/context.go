@@ -0,0 +1,189 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// How long cancelled attempts may take to return when the pool is interrupted
+const interruptGrace = 5 * time.Second
+
+var (
+	mInterruptedJobs = metrics.NewCounter("interrupted_jobs")
+)
+
+// JobInfo describes the attempt of the job, handlers get it from their context.
+type JobInfo struct {
+	ID     uint64
+	Action string
+	// Number of the attempt, starting from 1
+	Attempt int
+	// When the job was added to the pool
+	Queued time.Time
+}
+
+type jobInfoKey struct{}
+
+// GetJobInfo returns the info of the job which runs with the context.
+func GetJobInfo(ctx context.Context) (JobInfo, bool) {
+	info, ok := ctx.Value(jobInfoKey{}).(JobInfo)
+	return info, ok
+}
+
+// Timeout limits every attempt of the job, the context of the handler is cancelled after it.
+func Timeout(d time.Duration) JobOption {
+	return func(j *job) {
+		j.timeout = d
+	}
+}
+
+// attempts keeps cancel functions of running attempts.
+type attempts struct {
+	mu      sync.Mutex
+	running map[uint64]*attempt
+}
+
+type attempt struct {
+	action  string
+	started time.Time
+	cancel  context.CancelFunc
+}
+
+func newAttempts() *attempts {
+	return &attempts{
+		running: make(map[uint64]*attempt),
+	}
+}
+
+// startAttempt returns the context of the attempt. It is cancelled when the timeout of the job expires,
+// when the job is cancelled, when the pool is interrupted or when the attempt is done.
+func (p *Pool) startAttempt(j *job) context.Context {
+	ctx := context.WithValue(p.ctx, jobInfoKey{}, JobInfo{
+		ID:      j.id,
+		Action:  j.action,
+		Attempt: j.attempts,
+		Queued:  j.queued,
+	})
+	var cancel context.CancelFunc
+	if j.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, j.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	a := p.attempts
+	a.mu.Lock()
+	a.running[j.id] = &attempt{action: j.action, started: j.started, cancel: cancel}
+	a.mu.Unlock()
+	if p.canceller.isCancelled(j.id) {
+		// The job is cancelled after it was taken from the queue
+		cancel()
+	}
+	return ctx
+}
+
+// attemptDone releases the context of the attempt.
+func (p *Pool) attemptDone(j *job) {
+	a := p.attempts
+	a.mu.Lock()
+	at, ok := a.running[j.id]
+	delete(a.running, j.id)
+	a.mu.Unlock()
+	if ok {
+		at.cancel()
+	}
+}
+
+func (a *attempts) has(id uint64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.running[id]
+	return ok
+}
+
+// cancel cancels the context of the running attempt, it returns false if the job is not running.
+func (a *attempts) cancel(id uint64) bool {
+	a.mu.Lock()
+	at, ok := a.running[id]
+	a.mu.Unlock()
+	if ok {
+		at.cancel()
+	}
+	return ok
+}
+
+// interrupt cancels contexts of all running attempts and reports them.
+func (p *Pool) interrupt() {
+	a := p.attempts
+	a.mu.Lock()
+	if len(a.running) > 0 {
+		log.Printf("%d jobs are still running, cancelling them", len(a.running))
+	}
+	now := time.Now()
+	for id, at := range a.running {
+		log.Printf("%s %d is cancelled after %s", at.action, id, now.Sub(at.started).Round(time.Millisecond))
+	}
+	a.mu.Unlock()
+	p.cancel()
+}
+
+// interrupted handles the attempt which failed because the pool is interrupted. The job is not
+// finished: it is left for the next start like jobs which are not started yet.
+func (p *Pool) interrupted(j job, err error) {
+	mInterruptedJobs.Inc()
+	p.statuses.interrupted(j.id, j.data, err, j.journaled)
+	if j.journaled {
+		log.Printf("%s %d is interrupted and kept in the journal", j.action, j.id)
+	} else {
+		log.Printf("%s %d is interrupted and dropped", j.action, j.id)
+	}
+	p.abandon(&j)
+}
+
+// abandon leaves the job which will not run in this process. It stays in the journal if it is
+// journaled, otherwise it is dropped.
+func (p *Pool) abandon(j *job) {
+	p.canceller.done(j)
+	if j.journaled {
+		atomic.AddInt32(&p.kept, 1)
+	} else {
+		atomic.AddInt32(&p.dropped, 1)
+	}
+	release(j.data)
+}
+
+// waitInterrupted waits for workers and cancelled attempts. Handlers which ignore the context
+// are waited for no longer than interruptGrace.
+func (p *Pool) waitInterrupted(workers *sync.WaitGroup) {
+	deadline := time.Now().Add(interruptGrace)
+	for p.GetActiveWorkers() > 0 || p.GetRunningJobs() > 0 {
+		if time.Now().After(deadline) {
+			log.Printf("%d jobs are not stopped after cancellation", p.GetRunningJobs())
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	workers.Wait()
+}
+
+// abandonPending leaves all jobs which are not started after the pool is interrupted.
+func (p *Pool) abandonPending() {
+	pending := p.scheduler.drain()
+	pending = append(pending, p.limiter.drain()...)
+	pending = append(pending, p.sequencer.drain()...)
+	pending = append(pending, p.dependencies.drain()...)
+	for {
+		j, ok := p.jobsQueue.poll()
+		if !ok {
+			break
+		}
+		pending = append(pending, j)
+	}
+	for i := range pending {
+		p.abandon(&pending[i])
+	}
+}
@@ -0,0 +1,112 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAttemptContext(t *testing.T) {
+	p := &Pool{Size: 1, QueueSize: 10, ScheduleSize: 1, StatusLimit: 10}
+	p.Init()
+	infos := make(chan JobInfo, 1)
+	p.RegisterAction("test", func(ctx context.Context, data any) error {
+		info, _ := GetJobInfo(ctx)
+		infos <- info
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	p.Start()
+
+	id, _ := p.AddJob("test", nil, Timeout(10*time.Millisecond))
+	info := <-infos
+	if info.ID != id || info.Attempt != 1 || info.Queued.IsZero() {
+		t.Errorf("Unexpected job info %+v", info)
+	}
+	for {
+		if status, _ := p.GetJobStatus(id); status.State == StateFailed {
+			if status.Error != context.DeadlineExceeded.Error() {
+				t.Errorf("The job must fail by the timeout, got %s", status.Error)
+			}
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	p.AddJob("test", nil)
+	p.AddJob("test", nil)
+	<-infos
+	start := time.Now()
+	p.Finish(20 * time.Millisecond)
+	if time.Since(start) > time.Second {
+		t.Error("Finish must not wait for the cancelled job")
+	}
+	if p.dropped != 2 {
+		t.Errorf("The running and the queued jobs must be dropped, got %d", p.dropped)
+	}
+	if !errors.Is(p.ctx.Err(), context.Canceled) {
+		t.Error("Contexts of attempts must be cancelled")
+	}
+}
+
+// memJournal keeps ids of unfinished jobs.
+type memJournal struct {
+	mu   sync.Mutex
+	jobs map[uint64]bool
+}
+
+func (m *memJournal) Append(id uint64, _ string, _ []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs[id] = true
+	return nil
+}
+
+func (m *memJournal) Done(id uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.jobs, id)
+	return nil
+}
+
+func (m *memJournal) Recover(func(uint64, string, []byte) error) error {
+	return nil
+}
+
+func (m *memJournal) Close() error {
+	return nil
+}
+
+func TestInterruptedStatus(t *testing.T) {
+	journal := &memJournal{jobs: make(map[uint64]bool)}
+	p := &Pool{Size: 1, QueueSize: 10, ScheduleSize: 1, StatusLimit: 10, Journal: journal}
+	p.Init()
+	p.RegisterCodec("test", stringCodec{})
+	started := make(chan struct{})
+	p.RegisterAction("test", func(ctx context.Context, data any) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	p.Start()
+
+	id, _ := p.AddJob("test", "data")
+	<-started
+	p.Finish(10 * time.Millisecond)
+	status, _ := p.GetJobStatus(id)
+	if status.State != StateQueued || status.Finished != nil {
+		t.Errorf("The interrupted job must be queued for the next start, got %s", status.State)
+	}
+	if !journal.jobs[id] {
+		t.Error("The interrupted job must stay in the journal")
+	}
+}
@@ -0,0 +1,335 @@
+package worker
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/json-iterator/go"
+)
+
+const deadLettersFlushInterval = time.Second
+
+var (
+	ErrNotFound = errors.New("not found")
+
+	json = jsoniter.ConfigFastest
+
+	mDeadLettersDropped = metrics.NewCounter("dead_letters_dropped")
+)
+
+// DeadLetter is a finally failed job.
+type DeadLetter struct {
+	ID       uint64    `json:"id,string"`
+	Action   string    `json:"action"`
+	Priority Priority  `json:"priority,omitempty"`
+	Attempts int       `json:"attempts"`
+	Failed   time.Time `json:"failed"`
+	Error    string    `json:"error"`
+	// Report of the last attempt
+	Result jsoniter.RawMessage `json:"result,omitempty"`
+	// Job data encoded by the codec of the action
+	Job jsoniter.RawMessage `json:"job"`
+	// Options of the job encoded like in the journal, they are restored on replay
+	Meta jsoniter.RawMessage `json:"meta,omitempty"`
+}
+
+// DeadLetterFilter selects dead letters, empty fields match everything.
+type DeadLetterFilter struct {
+	Action string
+	// Substring of the error
+	Error  string
+	Before time.Time
+	After  time.Time
+}
+
+func (f *DeadLetterFilter) match(l *DeadLetter) bool {
+	return (f.Action == "" || f.Action == l.Action) &&
+		(f.Error == "" || strings.Contains(l.Error, f.Error)) &&
+		(f.Before.IsZero() || l.Failed.Before(f.Before)) &&
+		(f.After.IsZero() || l.Failed.After(f.After))
+}
+
+// DeadLetterQueue keeps up to Limit failed jobs, the oldest are dropped first.
+// If Path is set, the queue is loaded from the file and saved back on changes.
+type DeadLetterQueue struct {
+	Limit int
+	Path  string
+
+	mu      sync.Mutex
+	letters *list.List
+	index   map[uint64]*list.Element
+	dirty   bool
+}
+
+// Open loads the queue from the file and starts saving it in background.
+func (q *DeadLetterQueue) Open() error {
+	q.letters = list.New()
+	q.index = make(map[uint64]*list.Element)
+	metrics.NewGauge("dead_letters", func() float64 {
+		return float64(q.Len())
+	})
+	if q.Path == "" {
+		return nil
+	}
+	if err := q.load(); err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(deadLettersFlushInterval) {
+			if err := q.Flush(); err != nil {
+				log.Printf("Could not save dead letters: %s", err.Error())
+			}
+		}
+	}()
+	return nil
+}
+
+func (q *DeadLetterQueue) Add(l *DeadLetter) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.index[l.ID] = q.letters.PushBack(l)
+	for q.letters.Len() > q.Limit {
+		oldest := q.letters.Remove(q.letters.Front()).(*DeadLetter)
+		delete(q.index, oldest.ID)
+		mDeadLettersDropped.Inc()
+	}
+	q.dirty = true
+}
+
+func (q *DeadLetterQueue) Get(id uint64) (*DeadLetter, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if e, ok := q.index[id]; ok {
+		return e.Value.(*DeadLetter), true
+	}
+	return nil, false
+}
+
+// List returns up to limit matching dead letters, the oldest first. Zero limit means no limit.
+func (q *DeadLetterQueue) List(filter DeadLetterFilter, limit int) []*DeadLetter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	result := make([]*DeadLetter, 0)
+	for e := q.letters.Front(); e != nil && (limit <= 0 || len(result) < limit); e = e.Next() {
+		if l := e.Value.(*DeadLetter); filter.match(l) {
+			result = append(result, l)
+		}
+	}
+	return result
+}
+
+func (q *DeadLetterQueue) Remove(id uint64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, ok := q.index[id]
+	if ok {
+		q.letters.Remove(e)
+		delete(q.index, id)
+		q.dirty = true
+	}
+	return ok
+}
+
+// Purge removes all matching dead letters and returns their amount.
+func (q *DeadLetterQueue) Purge(filter DeadLetterFilter) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	removed := 0
+	for e := q.letters.Front(); e != nil; {
+		next := e.Next()
+		if l := e.Value.(*DeadLetter); filter.match(l) {
+			q.letters.Remove(e)
+			delete(q.index, l.ID)
+			removed++
+		}
+		e = next
+	}
+	if removed > 0 {
+		q.dirty = true
+	}
+	return removed
+}
+
+func (q *DeadLetterQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.letters.Len()
+}
+
+// Flush saves the queue to the file if it was changed.
+func (q *DeadLetterQueue) Flush() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.Path == "" || !q.dirty {
+		return nil
+	}
+	tmp := q.Path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	stream := json.BorrowStream(w)
+	for e := q.letters.Front(); e != nil && err == nil; e = e.Next() {
+		stream.WriteVal(e.Value)
+		stream.WriteRaw("\n")
+		err = stream.Flush()
+	}
+	json.ReturnStream(stream)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err0 := f.Close(); err == nil {
+		err = err0
+	}
+	if err == nil {
+		err = os.Rename(tmp, q.Path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	q.dirty = false
+	return nil
+}
+
+func (q *DeadLetterQueue) load() error {
+	f, err := os.Open(q.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		l := &DeadLetter{}
+		if err = json.Unmarshal(scanner.Bytes(), l); err != nil {
+			return err
+		}
+		q.index[l.ID] = q.letters.PushBack(l)
+		if q.letters.Len() > q.Limit {
+			delete(q.index, q.letters.Remove(q.letters.Front()).(*DeadLetter).ID)
+		}
+	}
+	return scanner.Err()
+}
+
+// deadLetter saves the finally failed job to the dead letter queue.
+func (p *Pool) deadLetter(j job, jobErr error) {
+	if p.DeadLetters == nil {
+		return
+	}
+	codec, ok := p.codecs[j.action]
+	if !ok {
+		return
+	}
+	payload, err := codec.Marshal(j.data)
+	if err != nil {
+		log.Printf("Could not save dead letter %d: %s", j.id, err.Error())
+		return
+	}
+	// Parents of the job have finished already, the replayed job does not wait for them
+	j.dependsOn = nil
+	meta, err := encodeMeta(&j)
+	if err != nil {
+		log.Printf("Could not save dead letter %d: %s", j.id, err.Error())
+		return
+	}
+	l := &DeadLetter{
+		ID:       j.id,
+		Action:   j.action,
+		Priority: j.priority,
+		Attempts: j.attempts,
+		Failed:   time.Now(),
+		Error:    jobErr.Error(),
+		Job:      payload,
+		Meta:     meta,
+	}
+	if r, ok := j.data.(Reporter); ok {
+		if report := r.Report(); report != nil {
+			l.Result, _ = json.Marshal(report)
+		}
+	}
+	p.DeadLetters.Add(l)
+}
+
+// ReplayDeadLetter puts the dead letter back to the queue as a new job and returns its id.
+func (p *Pool) ReplayDeadLetter(id uint64) (uint64, error) {
+	if p.DeadLetters == nil {
+		return 0, ErrNotFound
+	}
+	l, ok := p.DeadLetters.Get(id)
+	if !ok || !p.DeadLetters.Remove(id) {
+		return 0, ErrNotFound
+	}
+	newID, err := p.replay(l)
+	if err != nil {
+		p.DeadLetters.Add(l)
+	}
+	return newID, err
+}
+
+// ReplayDeadLetters replays all matching dead letters. It stops on the first error,
+// the rest of dead letters stay in the queue.
+func (p *Pool) ReplayDeadLetters(filter DeadLetterFilter) ([]uint64, error) {
+	ids := make([]uint64, 0)
+	if p.DeadLetters == nil {
+		return ids, nil
+	}
+	for _, l := range p.DeadLetters.List(filter, 0) {
+		if !p.DeadLetters.Remove(l.ID) {
+			continue
+		}
+		id, err := p.replay(l)
+		if err != nil {
+			p.DeadLetters.Add(l)
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (p *Pool) replay(l *DeadLetter) (uint64, error) {
+	codec, ok := p.codecs[l.Action]
+	if !ok {
+		return 0, errors.New("no codec for action " + l.Action)
+	}
+	// Dead letters saved without meta keep only the priority
+	restored := job{priority: l.Priority}
+	if err := decodeMeta(&restored, l.Meta); err != nil {
+		return 0, err
+	}
+	data, err := codec.Unmarshal(l.Job)
+	if err != nil {
+		return 0, err
+	}
+	id, err := p.AddJob(l.Action, data, restoreOptions(&restored))
+	if err != nil {
+		release(data)
+	}
+	return id, err
+}
+
+// restoreOptions copies options of the failed job to the replayed one. The replayed job runs
+// right away, so the time of the failed one is not restored.
+func restoreOptions(from *job) JobOption {
+	return func(j *job) {
+		j.priority = from.priority
+		j.orderingKey = from.orderingKey
+		j.timeout = from.timeout
+		j.tags = from.tags
+	}
+}
@@ -0,0 +1,41 @@
+package worker
+
+import (
+	"container/list"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReplayKeepsOptions(t *testing.T) {
+	p := &Pool{Size: 1, QueueSize: 10, ScheduleSize: 1}
+	p.DeadLetters = &DeadLetterQueue{Limit: 10, letters: list.New(), index: make(map[uint64]*list.Element)}
+	p.Init()
+	p.RegisterCodec("test", stringCodec{})
+
+	p.deadLetter(job{
+		id:          1,
+		action:      "test",
+		data:        "data",
+		priority:    PriorityHigh,
+		orderingKey: "order",
+		timeout:     time.Second,
+		tags:        []string{"user:42"},
+		dependsOn:   []uint64{2},
+	}, errors.New("failed"))
+	id, err := p.ReplayDeadLetter(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, ok := p.jobsQueue.poll()
+	if !ok || j.id != id || j.data != "data" {
+		t.Fatalf("The replayed job must be queued, got %d", j.id)
+	}
+	if j.priority != PriorityHigh || j.orderingKey != "order" || j.timeout != time.Second ||
+		len(j.tags) != 1 || j.tags[0] != "user:42" {
+		t.Errorf("Options of the failed job must be restored, got %+v", j)
+	}
+	if len(j.dependsOn) != 0 {
+		t.Errorf("The replayed job must not wait for finished parents, got %v", j.dependsOn)
+	}
+}
@@ -0,0 +1,201 @@
+package worker
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/json-iterator/go"
+)
+
+// Decoder converts jobs submitted to the web api into job data. It validates the json,
+// so invalid jobs are rejected before anything is queued.
+type Decoder interface {
+	// Decode decodes a single json object, it may produce several jobs
+	Decode(b []byte) ([]NewJob, error)
+	// Schema returns the json schema of the object accepted by Decode
+	Schema() []byte
+}
+
+// NewJob is the decoded job which is ready to be added to the pool.
+type NewJob struct {
+	Data    any
+	Options []JobOption
+	// Indexes of earlier jobs of the batch which must succeed before the job runs
+	DependsOn []int
+}
+
+// ActionInfo describes the registered action.
+type ActionInfo struct {
+	Name           string `json:"name"`
+	MaxConcurrency int    `json:"maxConcurrency,omitempty"`
+	// Budget of jobs in flight of the async action
+	InFlight int `json:"inFlight,omitempty"`
+	// Jobs of the action are journaled and can be handed off
+	Persistent bool                `json:"persistent"`
+	Schema     jsoniter.RawMessage `json:"schema,omitempty"`
+}
+
+// RegisterDecoder makes the action available in the web api.
+func (p *Pool) RegisterDecoder(action string, decoder Decoder) {
+	p.decoders[action] = decoder
+}
+
+// GetDecoder returns the decoder of the action or nil if the action has no decoder.
+func (p *Pool) GetDecoder(action string) Decoder {
+	return p.decoders[action]
+}
+
+// GetActions returns registered actions sorted by name.
+func (p *Pool) GetActions() []ActionInfo {
+	infos := make([]ActionInfo, 0, len(p.actions))
+	for name, a := range p.actions {
+		info := ActionInfo{
+			Name:           name,
+			MaxConcurrency: a.maxConcurrency,
+			InFlight:       cap(a.inFlight),
+		}
+		_, info.Persistent = p.codecs[name]
+		if d, ok := p.decoders[name]; ok {
+			info.Schema = d.Schema()
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// DecodeItems decodes the json object or array of objects submitted to the web api. Jobs of every
+// item are decoded separately, items which could not be decoded have nil jobs and their error.
+// The returned error means the body is not valid json.
+//
+// The key is the idempotency key of the whole request, every item and every job of the item gets
+// its own key derived from it. Keys set by the decoder take precedence.
+//
+// Items of the array may have the "ref" name and "dependsOn" references to earlier items, see
+// ResolveDependsOn. Every job of the item depends on all jobs of the referenced items. Indexes
+// in NewJob.DependsOn are rebased to the whole request, as if all items were a single batch.
+func DecodeItems(decoder Decoder, body []byte, key string) ([][]NewJob, []error, error) {
+	if len(body) < 2 || (body[0] != '[' && body[0] != '{') {
+		return nil, nil, errors.New("invalid json data")
+	}
+	var raws [][]byte
+	if body[0] == '[' {
+		iter := json.BorrowIterator(body)
+		defer json.ReturnIterator(iter)
+		for iter.ReadArray() {
+			raws = append(raws, iter.SkipAndReturnBytes())
+		}
+		if iter.Error != nil && iter.Error != io.EOF {
+			return nil, nil, errors.New("invalid json data")
+		}
+	} else {
+		raws = [][]byte{body}
+	}
+	items := make([][]NewJob, len(raws))
+	errs := make([]error, len(raws))
+	refs := make(map[string]int)
+	// Index of the first job of every item in the whole request
+	offsets := make([]int, len(raws)+1)
+	for i, raw := range raws {
+		var parents []int
+		if body[0] == '[' {
+			parents, errs[i] = readItemDependencies(raw, i, refs)
+		}
+		for _, parent := range parents {
+			if errs[parent] != nil {
+				errs[i] = errors.New("dependency item " + strconv.Itoa(parent) + " is invalid")
+				break
+			}
+		}
+		if errs[i] == nil {
+			items[i], errs[i] = decoder.Decode(raw)
+		}
+		offsets[i+1] = offsets[i] + len(items[i])
+		for k := range items[i] {
+			nj := &items[i][k]
+			for d := range nj.DependsOn {
+				nj.DependsOn[d] += offsets[i]
+			}
+			for _, parent := range parents {
+				for d := offsets[parent]; d < offsets[parent+1]; d++ {
+					nj.DependsOn = append(nj.DependsOn, d)
+				}
+			}
+			if key != "" {
+				opts := []JobOption{IdempotencyKey(SubKey(SubKey(key, i, len(raws)), k, len(items[i])))}
+				nj.Options = append(opts, nj.Options...)
+			}
+		}
+	}
+	return items, errs, nil
+}
+
+// readItemDependencies reads the ref and dependsOn fields of the i-th item.
+func readItemDependencies(raw []byte, i int, refs map[string]int) ([]int, error) {
+	iter := json.BorrowIterator(raw)
+	defer json.ReturnIterator(iter)
+	var dependsOn []byte
+	for field := iter.ReadObject(); field != ""; field = iter.ReadObject() {
+		switch field {
+		case "ref":
+			ref := iter.ReadString()
+			if _, ok := refs[ref]; ok {
+				return nil, errors.New("duplicate ref " + ref)
+			}
+			refs[ref] = i
+		case "dependsOn":
+			dependsOn = iter.SkipAndReturnBytes()
+		default:
+			iter.Skip()
+		}
+	}
+	if iter.Error != nil && iter.Error != io.EOF {
+		return nil, iter.Error
+	}
+	if dependsOn == nil {
+		return nil, nil
+	}
+	return ResolveDependsOn(dependsOn, i, refs)
+}
+
+// ResolveDependsOn converts the json array of references of the i-th item to indexes of earlier
+// items. A reference is the index of the item or its ref name.
+func ResolveDependsOn(b []byte, i int, refs map[string]int) ([]int, error) {
+	iter := json.BorrowIterator(b)
+	defer json.ReturnIterator(iter)
+	var parents []int
+	for iter.ReadArray() {
+		var parent int
+		switch iter.WhatIsNext() {
+		case jsoniter.NumberValue:
+			parent = iter.ReadInt()
+		case jsoniter.StringValue:
+			ref := iter.ReadString()
+			var ok bool
+			if parent, ok = refs[ref]; !ok {
+				return nil, errors.New("unknown ref " + ref + " in dependsOn")
+			}
+		default:
+			return nil, errors.New("dependsOn must contain indexes or refs")
+		}
+		if parent < 0 || parent >= i {
+			return nil, errors.New("dependsOn must reference earlier items")
+		}
+		parents = append(parents, parent)
+	}
+	if iter.Error != nil && iter.Error != io.EOF {
+		return nil, iter.Error
+	}
+	return parents, nil
+}
+
+// ReleaseJobs recycles data of decoded jobs which were not added to the pool.
+func ReleaseJobs(jobs []NewJob) {
+	for _, j := range jobs {
+		release(j.Data)
+	}
+}
@@ -0,0 +1,185 @@
+package worker
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DependsOn holds the job until the jobs with the ids succeed. If any of them fails, the job
+// fails without running and goes to dead letters. Finished jobs are looked up in job statuses,
+// unknown ids are considered succeeded.
+func DependsOn(ids ...uint64) JobOption {
+	return func(j *job) {
+		j.dependsOn = append(j.dependsOn, ids...)
+	}
+}
+
+// DependencyError is the error of the job whose dependency failed.
+type DependencyError struct {
+	ID uint64
+}
+
+func (e *DependencyError) Error() string {
+	return "dependency " + strconv.FormatUint(e.ID, 10) + " failed"
+}
+
+// dependencies holds jobs until their parents succeed.
+type dependencies struct {
+	mu      sync.Mutex
+	blocked map[uint64]*blockedJob
+	// Ids of blocked jobs by ids of their unfinished parents
+	children map[uint64][]uint64
+}
+
+type blockedJob struct {
+	job job
+	// Amount of unfinished parents
+	remaining int
+}
+
+func newDependencies() *dependencies {
+	return &dependencies{
+		blocked:  make(map[uint64]*blockedJob),
+		children: make(map[uint64][]uint64),
+	}
+}
+
+// add holds the job if it has unfinished parents. Jobs from pending and tracked jobs are unfinished
+// for sure, others are looked up in statuses. It returns the id of the failed parent if the job must fail.
+func (d *dependencies) add(j job, pending map[uint64]bool, statuses *statusStore) (held bool, failed uint64) {
+	if len(j.dependsOn) == 0 {
+		return false, 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var waitFor []uint64
+	for _, id := range j.dependsOn {
+		_, blocked := d.blocked[id]
+		_, parent := d.children[id]
+		if !blocked && !parent && !pending[id] {
+			status, ok := statuses.get(id)
+			// The cancelled parent did not succeed either
+			if ok && (status.State == StateFailed || status.State == StateCancelled) {
+				return false, id
+			}
+			if !ok || status.State == StateSucceeded {
+				continue
+			}
+		}
+		waitFor = append(waitFor, id)
+	}
+	if len(waitFor) == 0 {
+		return false, 0
+	}
+	for _, id := range waitFor {
+		d.children[id] = append(d.children[id], j.id)
+	}
+	d.blocked[j.id] = &blockedJob{job: j, remaining: len(waitFor)}
+	return true, 0
+}
+
+// finished releases children of the finished job. Children whose parents all succeeded are
+// ready to run, children of the failed job must fail.
+func (d *dependencies) finished(id uint64, success bool) (ready []job, failed []job) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	children, ok := d.children[id]
+	if !ok {
+		return nil, nil
+	}
+	delete(d.children, id)
+	for _, child := range children {
+		b, ok := d.blocked[child]
+		if !ok {
+			// Already failed because of another parent
+			continue
+		}
+		if !success {
+			delete(d.blocked, child)
+			failed = append(failed, b.job)
+			continue
+		}
+		b.remaining--
+		if b.remaining == 0 {
+			delete(d.blocked, child)
+			ready = append(ready, b.job)
+		}
+	}
+	return ready, failed
+}
+
+// drop removes blocked descendants of the job which will not run in this process.
+func (d *dependencies) drop(id uint64) []job {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var dropped []job
+	queue := []uint64{id}
+	for len(queue) > 0 {
+		id, queue = queue[0], queue[1:]
+		for _, child := range d.children[id] {
+			if b, ok := d.blocked[child]; ok {
+				delete(d.blocked, child)
+				dropped = append(dropped, b.job)
+				queue = append(queue, child)
+			}
+		}
+		delete(d.children, id)
+	}
+	return dropped
+}
+
+// drain removes all blocked jobs.
+func (d *dependencies) drain() []job {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	jobs := make([]job, 0, len(d.blocked))
+	for _, b := range d.blocked {
+		jobs = append(jobs, b.job)
+	}
+	d.blocked = make(map[uint64]*blockedJob)
+	d.children = make(map[uint64][]uint64)
+	return jobs
+}
+
+// involved returns true if the job waits for parents or has waiting children.
+func (d *dependencies) involved(id uint64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, blocked := d.blocked[id]
+	_, parent := d.children[id]
+	return blocked || parent
+}
+
+// len returns amount of blocked jobs.
+func (d *dependencies) len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.blocked)
+}
+
+// dependenciesDone releases children of the finished job, children of the failed job fail too.
+func (p *Pool) dependenciesDone(j *job, success bool) {
+	ready, failed := p.dependencies.finished(j.id, success)
+	now := time.Now()
+	for _, child := range ready {
+		// Do not block the caller, the scheduler moves jobs to the queue
+		if child.runAt.After(now) {
+			p.statuses.released(child.id, StateScheduled)
+			p.scheduler.add(child, child.runAt)
+		} else {
+			p.statuses.released(child.id, StateQueued)
+			p.scheduler.add(child, now)
+		}
+	}
+	for _, child := range failed {
+		p.dependencyFailed(child, j.id)
+	}
+}
+
+// dependencyFailed finishes the job which will not run because its parent failed.
+func (p *Pool) dependencyFailed(j job, parent uint64) {
+	// Later jobs with the coalesce key must not be merged into the failed job
+	p.coalescer.take(&j)
+	p.complete(j, &DependencyError{ID: parent})
+}
@@ -0,0 +1,77 @@
+package worker
+
+import "testing"
+
+func TestDependencies(t *testing.T) {
+	d := newDependencies()
+	pending := map[uint64]bool{1: true, 2: true}
+	if held, _ := d.add(job{id: 3, dependsOn: []uint64{1, 2}}, pending, nil); !held {
+		t.Fatal("The child of pending jobs must be held")
+	}
+	if held, _ := d.add(job{id: 4, dependsOn: []uint64{3}}, pending, nil); !held {
+		t.Fatal("The child of the held job must be held")
+	}
+	if held, _ := d.add(job{id: 5, dependsOn: []uint64{100}}, pending, nil); held {
+		t.Fatal("Unknown parents are considered succeeded")
+	}
+
+	if ready, _ := d.finished(1, true); len(ready) != 0 {
+		t.Fatal("The child must wait for all parents")
+	}
+	if ready, _ := d.finished(2, true); len(ready) != 1 || ready[0].id != 3 {
+		t.Fatal("The child must be ready when all parents are succeeded")
+	}
+	if _, failed := d.finished(3, false); len(failed) != 1 || failed[0].id != 4 {
+		t.Fatal("The child of the failed job must fail")
+	}
+	if d.len() != 0 {
+		t.Fatalf("Expected no blocked jobs, got %d", d.len())
+	}
+}
+
+func TestAddDependentJobs(t *testing.T) {
+	p := &Pool{Size: 1, QueueSize: 2, ScheduleSize: 1, StatusLimit: 10}
+	p.Init()
+
+	if _, err := p.AddJobs("test", []NewJob{{Data: 1, DependsOn: []int{0}}}); err != ErrInvalidDependency {
+		t.Fatalf("The job must not depend on itself, got %v", err)
+	}
+	ids, err := p.AddJobs("test", []NewJob{{Data: 1}, {Data: 2, DependsOn: []int{0}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.GetQueueLength() != 1 || p.GetWaitingJobs() != 1 {
+		t.Fatal("Only the parent must be queued")
+	}
+	if status, _ := p.GetJobStatus(ids[1]); status.State != StateWaiting {
+		t.Errorf("The child must be waiting, got %s", status.State)
+	}
+	if _, err = p.AddJobs("test", []NewJob{{Data: 3}, {Data: 4, DependsOn: []int{0}}}); err != ErrScheduleFull {
+		t.Fatalf("Waiting jobs must count against the schedule size, got %v", err)
+	}
+}
+
+type testDecoder struct{}
+
+func (testDecoder) Decode(b []byte) ([]NewJob, error) {
+	return []NewJob{{Data: string(b)}, {Data: string(b), DependsOn: []int{0}}}, nil
+}
+
+func (testDecoder) Schema() []byte {
+	return nil
+}
+
+func TestDecodeItemDependencies(t *testing.T) {
+	items, errs, err := DecodeItems(testDecoder{}, []byte(`[{"ref":"a"},{"dependsOn":["a"]},{"dependsOn":[3]}]`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs[0] != nil || errs[1] != nil || errs[2] == nil {
+		t.Fatalf("Only the forward reference must be rejected, got %v", errs)
+	}
+	second := items[1]
+	if len(second[0].DependsOn) != 2 || len(second[1].DependsOn) != 3 || second[1].DependsOn[0] != 2 {
+		t.Errorf("Jobs must depend on all jobs of the parent item with rebased indexes, got %v %v",
+			second[0].DependsOn, second[1].DependsOn)
+	}
+}
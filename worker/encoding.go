@@ -0,0 +1,99 @@
+package worker
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// jobMeta keeps options of the job which must survive restarts and handoffs.
+type jobMeta struct {
+	RunAt       int64    `json:"runAt,omitempty"`
+	Priority    Priority `json:"priority,omitempty"`
+	OrderingKey string   `json:"orderingKey,omitempty"`
+	DependsOn   []uint64 `json:"dependsOn,omitempty"`
+	Timeout     int64    `json:"timeout,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+// encodeJob encodes the job data with the codec of the action and prepends options.
+//
+//	len(meta) uvarint | meta json | codec payload
+func (p *Pool) encodeJob(j *job) ([]byte, error) {
+	codec, ok := p.codecs[j.action]
+	if !ok {
+		return nil, errors.New("no codec for action " + j.action)
+	}
+	payload, err := codec.Marshal(j.data)
+	if err != nil {
+		return nil, err
+	}
+	metaBytes, err := encodeMeta(j)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, binary.MaxVarintLen64+len(metaBytes)+len(payload))
+	buf = binary.AppendUvarint(buf, uint64(len(metaBytes)))
+	buf = append(buf, metaBytes...)
+	return append(buf, payload...), nil
+}
+
+// decodeJob fills the job from the data encoded by encodeJob.
+func (p *Pool) decodeJob(j *job, b []byte) error {
+	codec, ok := p.codecs[j.action]
+	if !ok {
+		return errors.New("no codec for action " + j.action)
+	}
+	metaLen, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < metaLen {
+		return errors.New("invalid encoded job")
+	}
+	b = b[n:]
+	if err := decodeMeta(j, b[:metaLen]); err != nil {
+		return err
+	}
+	data, err := codec.Unmarshal(b[metaLen:])
+	if err != nil {
+		return err
+	}
+	j.data = data
+	return nil
+}
+
+// encodeMeta returns options of the job as json, or nil if all of them are default.
+func encodeMeta(j *job) ([]byte, error) {
+	meta := jobMeta{}
+	if !j.runAt.IsZero() {
+		meta.RunAt = j.runAt.UnixNano()
+	}
+	meta.Priority = j.priority
+	meta.OrderingKey = j.orderingKey
+	meta.DependsOn = j.dependsOn
+	meta.Timeout = int64(j.timeout)
+	meta.Tags = j.tags
+	if meta.RunAt == 0 && meta.Priority == 0 && meta.OrderingKey == "" && len(meta.DependsOn) == 0 &&
+		meta.Timeout == 0 && len(meta.Tags) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(meta)
+}
+
+// decodeMeta fills options of the job encoded by encodeMeta, empty meta keeps them default.
+func decodeMeta(j *job, b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	meta := jobMeta{}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return err
+	}
+	if meta.RunAt != 0 {
+		j.runAt = time.Unix(0, meta.RunAt)
+	}
+	j.priority = meta.Priority
+	j.orderingKey = meta.OrderingKey
+	j.dependsOn = meta.DependsOn
+	j.timeout = time.Duration(meta.Timeout)
+	j.tags = meta.Tags
+	return nil
+}
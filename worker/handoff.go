@@ -0,0 +1,237 @@
+package worker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"time"
+)
+
+const handoffTimeout = 10 * time.Second
+
+// How many times the job is sent again over new connections when its acknowledgement is lost
+const handoffRetries = 3
+
+// Ids of received jobs are kept this long, the sender resends the job with the lost acknowledgement sooner
+const handoffDedupWindow = (handoffRetries + 1) * handoffTimeout
+
+const (
+	handoffRejected byte = 0
+	handoffAccepted byte = 1
+)
+
+var (
+	errHandoffRejected = errors.New("job is rejected by the receiver")
+)
+
+// Handoff sends not started jobs to another process over connections opened by dial and closes
+// the pool for new jobs. Every job is removed from this pool only after the receiver acknowledges
+// it. When the connection breaks before the acknowledgement, the job is sent again over a new one,
+// and the receiver acknowledges jobs it already has without queueing them twice. Jobs that could
+// not be handed off stay in the queue and will be executed here.
+func (p *Pool) Handoff(dial func() (net.Conn, error)) (int, error) {
+	p.finish = true
+
+	var conn net.Conn
+	var rw *bufio.ReadWriter
+	defer func() {
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}()
+	retries := 0
+	var local []job
+	var err error
+	sent := 0
+	// Delayed jobs, retries, jobs waiting for concurrency limits or for previous jobs with
+	// their ordering keys are not started yet either
+	pending := p.scheduler.drain()
+	pending = append(pending, p.limiter.drain()...)
+	pending = append(pending, p.sequencer.drain()...)
+	for {
+		j, ok := p.jobsQueue.poll()
+		if !ok {
+			break
+		}
+		pending = append(pending, j)
+	}
+	// Ids grow in the order of submission, the receiver keeps the order of jobs with ordering keys
+	sort.Slice(pending, func(i, k int) bool {
+		return pending[i].id < pending[k].id
+	})
+	for len(pending) > 0 {
+		var j job
+		j, pending = pending[0], pending[1:]
+		if _, ok := p.codecs[j.action]; !ok {
+			local = append(local, j)
+			continue
+		}
+		if !p.sequencer.isHead(&j) {
+			// The previous job with the ordering key is running here
+			local = append(local, j)
+			continue
+		}
+		if p.dependencies.involved(j.id) {
+			// Children wait for their parents here
+			local = append(local, j)
+			continue
+		}
+		// The receiver gets the latest data of the coalesced job
+		p.coalescer.take(&j)
+		payload, marshalErr := p.encodeJob(&j)
+		if marshalErr != nil {
+			log.Printf("Could not hand off job %d: %s", j.id, marshalErr.Error())
+			local = append(local, j)
+			continue
+		}
+		if conn == nil {
+			if conn, err = dial(); err != nil {
+				conn = nil
+				local = append(local, j)
+				break
+			}
+			rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+		}
+		_ = conn.SetDeadline(time.Now().Add(handoffTimeout))
+		if err = sendHandoffJob(rw, j, payload); err == errHandoffRejected {
+			local = append(local, j)
+			break
+		} else if err != nil {
+			// The receiver may have queued the job, it is sent again to learn it
+			_ = conn.Close()
+			conn = nil
+			if retries++; retries > handoffRetries {
+				local = append(local, j)
+				break
+			}
+			log.Printf("Handoff connection is broken, sending job %d again: %s", j.id, err.Error())
+			pending = append([]job{j}, pending...)
+			continue
+		}
+		p.limiter.forget(&j)
+		p.sequenceDone(&j)
+		p.canceller.done(&j)
+		p.journalDone(j)
+		release(j.data)
+		sent++
+	}
+
+	for _, j := range append(local, pending...) {
+		p.requeue(j)
+	}
+	return sent, err
+}
+
+// ReceiveHandoff reads jobs sent by Handoff from another process and puts them to the queue.
+func (p *Pool) ReceiveHandoff(conn net.Conn) (int, error) {
+	p.forgetHandedIn()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	received := 0
+	for {
+		_ = conn.SetDeadline(time.Now().Add(handoffTimeout))
+		j, payload, err := readHandoffJob(rw)
+		if err == io.EOF {
+			p.forgetHandedIn()
+			return received, nil
+		} else if err != nil {
+			return received, err
+		}
+
+		ack, queued := p.receiveHandoffJob(j, payload)
+		if queued {
+			received++
+		}
+		if err = rw.WriteByte(ack); err == nil {
+			err = rw.Flush()
+		}
+		if err != nil {
+			return received, err
+		}
+	}
+}
+
+// receiveHandoffJob queues the job unless it is received already. The sender sends the job again
+// when the acknowledgement is lost, so the job is remembered before the acknowledgement.
+func (p *Pool) receiveHandoffJob(j job, payload []byte) (byte, bool) {
+	p.handoffMu.Lock()
+	defer p.handoffMu.Unlock()
+	if _, ok := p.handedIn[j.id]; ok {
+		return handoffAccepted, false
+	}
+	if err := p.decodeJob(&j, payload); err != nil {
+		log.Printf("Rejected handed off job %d: %s", j.id, err.Error())
+		return handoffRejected, false
+	}
+	if err := p.enqueue(j); err != nil {
+		log.Printf("Rejected handed off job %d: %s", j.id, err.Error())
+		return handoffRejected, false
+	}
+	if p.handedIn == nil {
+		p.handedIn = make(map[uint64]time.Time)
+	}
+	p.handedIn[j.id] = time.Now()
+	return handoffAccepted, true
+}
+
+// forgetHandedIn drops ids of jobs which were received too long ago to be sent again.
+func (p *Pool) forgetHandedIn() {
+	p.handoffMu.Lock()
+	defer p.handoffMu.Unlock()
+	expired := time.Now().Add(-handoffDedupWindow)
+	for id, received := range p.handedIn {
+		if received.Before(expired) {
+			delete(p.handedIn, id)
+		}
+	}
+}
+
+// Frame layout:
+//
+//	id uint64 | len(action) uint16 | action | len(payload) uint32 | payload
+func sendHandoffJob(rw *bufio.ReadWriter, j job, payload []byte) error {
+	var header [14]byte
+	binary.LittleEndian.PutUint64(header[0:], j.id)
+	binary.LittleEndian.PutUint16(header[8:], uint16(len(j.action)))
+	_, _ = rw.Write(header[:10])
+	_, _ = rw.WriteString(j.action)
+	binary.LittleEndian.PutUint32(header[10:], uint32(len(payload)))
+	_, _ = rw.Write(header[10:])
+	_, _ = rw.Write(payload)
+	if err := rw.Flush(); err != nil {
+		return err
+	}
+	ack, err := rw.ReadByte()
+	if err != nil {
+		return err
+	}
+	if ack != handoffAccepted {
+		return errHandoffRejected
+	}
+	return nil
+}
+
+func readHandoffJob(rw *bufio.ReadWriter) (job, []byte, error) {
+	var j job
+	var header [10]byte
+	if _, err := io.ReadFull(rw, header[:]); err != nil {
+		return j, nil, err
+	}
+	j.id = binary.LittleEndian.Uint64(header[0:])
+	action := make([]byte, binary.LittleEndian.Uint16(header[8:]))
+	if _, err := io.ReadFull(rw, action); err != nil {
+		return j, nil, err
+	}
+	j.action = string(action)
+	if _, err := io.ReadFull(rw, header[:4]); err != nil {
+		return j, nil, err
+	}
+	payload := make([]byte, binary.LittleEndian.Uint32(header[:4]))
+	if _, err := io.ReadFull(rw, payload); err != nil {
+		return j, nil, err
+	}
+	return j, payload, nil
+}
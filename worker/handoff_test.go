@@ -0,0 +1,84 @@
+package worker
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type stringCodec struct{}
+
+func (stringCodec) Marshal(data any) ([]byte, error) {
+	return []byte(data.(string)), nil
+}
+
+func (stringCodec) Unmarshal(b []byte) (any, error) {
+	return string(b), nil
+}
+
+// cutConn closes the connection instead of writing the acknowledgement.
+type cutConn struct {
+	net.Conn
+}
+
+func (c cutConn) Write([]byte) (int, error) {
+	_ = c.Conn.Close()
+	return 0, errors.New("connection is cut")
+}
+
+func TestHandoffLostAck(t *testing.T) {
+	newPool := func() *Pool {
+		p := &Pool{Size: 1, QueueSize: 10, ScheduleSize: 1}
+		p.Init()
+		p.RegisterCodec("test", stringCodec{})
+		return p
+	}
+	sender, receiver := newPool(), newPool()
+	id, err := sender.AddJob("test", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	connections := 0
+	sent, err := sender.Handoff(func() (net.Conn, error) {
+		connections++
+		local, remote := net.Pipe()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if connections == 1 {
+				// The job is queued by the receiver, but the sender does not learn it
+				_, _ = receiver.ReceiveHandoff(cutConn{remote})
+				return
+			}
+			_, _ = receiver.ReceiveHandoff(remote)
+			_ = remote.Close()
+		}()
+		return local, nil
+	})
+	wg.Wait()
+	if err != nil || sent != 1 || connections != 2 {
+		t.Fatalf("The job must be sent again over the new connection, sent %d over %d connections: %v", sent, connections, err)
+	}
+	if sender.GetQueueLength() != 0 {
+		t.Errorf("The sender must drop the acknowledged job, got %d queued", sender.GetQueueLength())
+	}
+	if receiver.GetQueueLength() != 1 {
+		t.Fatalf("The receiver must queue the job once, got %d queued", receiver.GetQueueLength())
+	}
+	if j, _ := receiver.jobsQueue.poll(); j.id != id || j.data != "data" {
+		t.Errorf("Expected job %d, got %d with %v", id, j.id, j.data)
+	}
+
+	// Ids are forgotten once the job can not be sent again
+	receiver.handedIn[id] = time.Now().Add(-handoffDedupWindow - time.Second)
+	local, remote := net.Pipe()
+	_ = local.Close()
+	_, _ = receiver.ReceiveHandoff(remote)
+	if len(receiver.handedIn) != 0 {
+		t.Errorf("Expired ids must be forgotten, got %d", len(receiver.handedIn))
+	}
+}
@@ -0,0 +1,56 @@
+package worker
+
+import (
+	"log"
+	"time"
+)
+
+// JobResult describes the finished job.
+type JobResult struct {
+	ID       uint64
+	Action   string
+	Attempts int
+	Queued   time.Time
+	// Start of the last attempt
+	Started  time.Time
+	Finished time.Time
+	// Error of the last attempt, nil if the job is succeeded
+	Err error
+}
+
+// FinishHook is called when the job is succeeded or finally failed, before the data is released.
+// It must not block, because it runs in the worker.
+type FinishHook func(result *JobResult, data any)
+
+// OnFinish adds the hook to the action.
+func OnFinish(hook FinishHook) ActionOption {
+	return func(a *action) {
+		a.onFinish = append(a.onFinish, hook)
+	}
+}
+
+func (p *Pool) finished(j *job, err error) {
+	a, ok := p.actions[j.action]
+	if !ok || len(a.onFinish) == 0 {
+		return
+	}
+	result := &JobResult{
+		ID:       j.id,
+		Action:   j.action,
+		Attempts: j.attempts,
+		Queued:   j.queued,
+		Started:  j.started,
+		Finished: time.Now(),
+		Err:      err,
+	}
+	for _, hook := range a.onFinish {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("panic in finish hook of %s %d: %v", j.action, j.id, r)
+				}
+			}()
+			hook(result, j.data)
+		}()
+	}
+}
@@ -0,0 +1,65 @@
+package worker
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/ReneKroon/ttlcache/v2"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	mDuplicateJobs = metrics.NewCounter("duplicate_jobs")
+)
+
+// IdempotencyKey deduplicates the job: while the key is remembered, jobs of the same action
+// with the key are not queued and the id of the original job is returned instead.
+func IdempotencyKey(key string) JobOption {
+	return func(j *job) {
+		j.idempotencyKey = key
+	}
+}
+
+// SubKey returns the idempotency key of the i-th of n jobs which share the key, for example
+// clones of a single request.
+func SubKey(key string, i, n int) string {
+	if n == 1 {
+		return key
+	}
+	return key + "#" + strconv.Itoa(i)
+}
+
+// idempotencyStore remembers ids of jobs by their idempotency keys for the window.
+type idempotencyStore struct {
+	cache *ttlcache.Cache
+}
+
+func newIdempotencyStore(window time.Duration, limit int) *idempotencyStore {
+	s := &idempotencyStore{
+		cache: ttlcache.NewCache(),
+	}
+	s.cache.SkipTTLExtensionOnHit(true)
+	_ = s.cache.SetTTL(window)
+	if limit > 0 {
+		s.cache.SetCacheSizeLimit(limit)
+	}
+	return s
+}
+
+func (s *idempotencyStore) get(action, key string) (uint64, bool) {
+	if s == nil {
+		return 0, false
+	}
+	val, err := s.cache.Get(action + ":" + key)
+	if err != nil {
+		return 0, false
+	}
+	return val.(uint64), true
+}
+
+func (s *idempotencyStore) set(action, key string, id uint64) {
+	if s == nil {
+		return
+	}
+	_ = s.cache.Set(action+":"+key, id)
+}
@@ -0,0 +1,37 @@
+package worker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	p := &Pool{Size: 1, QueueSize: 10, IdempotencyWindow: time.Minute}
+	p.Init()
+
+	first, err := p.AddJob("test", 1, IdempotencyKey("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := p.AddJob("test", 2, IdempotencyKey("a")); id != first {
+		t.Errorf("The duplicate must return the original id %d, got %d", first, id)
+	}
+	if id, _ := p.AddJob("other", 3, IdempotencyKey("a")); id == first {
+		t.Error("Keys of different actions must not clash")
+	}
+
+	ids, err := p.AddJobs("test", []NewJob{
+		{Data: 4, Options: []JobOption{IdempotencyKey("a")}},
+		{Data: 5, Options: []JobOption{IdempotencyKey("b")}},
+		{Data: 6, Options: []JobOption{IdempotencyKey("b")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids[0] != first || ids[1] != ids[2] {
+		t.Errorf("Duplicates in the batch must return original ids, got %v", ids)
+	}
+	if p.GetQueueLength() != 3 {
+		t.Errorf("Expected 3 queued jobs, got %d", p.GetQueueLength())
+	}
+}
@@ -0,0 +1,99 @@
+package worker
+
+import (
+	"log"
+	"time"
+)
+
+const journalRecoverInterval = 30 * time.Second
+
+func (p *Pool) journalAppend(j *job) error {
+	if p.Journal == nil {
+		return nil
+	}
+	if _, ok := p.codecs[j.action]; !ok {
+		return nil
+	}
+	payload, err := p.encodeJob(j)
+	if err != nil {
+		return err
+	}
+	if err = p.Journal.Append(j.id, j.action, payload); err != nil {
+		return err
+	}
+	j.journaled = true
+	return nil
+}
+
+func (p *Pool) journalDone(j job) {
+	if !j.journaled {
+		return
+	}
+	if err := p.Journal.Done(j.id); err != nil {
+		log.Printf("Could not mark job %d as done in journal: %s", j.id, err.Error())
+	}
+}
+
+// replayJournal puts unfinished jobs of dead processes back to the queue. Jobs keep their ids.
+// It blocks while the queue is full.
+func (p *Pool) replayJournal() {
+	if p.finish {
+		return
+	}
+	var recovered []job
+	err := p.Journal.Recover(func(id uint64, action string, payload []byte) error {
+		j := job{
+			id:     id,
+			action: action,
+			queued: time.Now(),
+		}
+		if err := p.decodeJob(&j, payload); err != nil {
+			log.Printf("Could not recover job %d: %s", id, err.Error())
+			return nil
+		}
+		if err := p.journalAppend(&j); err != nil {
+			return err
+		}
+		p.sequencer.add(&j)
+		p.canceller.add(&j)
+		recovered = append(recovered, j)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Could not recover jobs from journal: %s", err.Error())
+	}
+	// Children are tracked before their recovered parents are queued
+	pending := make(map[uint64]bool, len(recovered))
+	for _, j := range recovered {
+		pending[j.id] = true
+	}
+	var failed []failedDependent
+	queued := recovered[:0]
+	for _, j := range recovered {
+		held, parent := p.dependencies.add(j, pending, p.statuses)
+		if parent != 0 {
+			failed = append(failed, failedDependent{job: j, parent: parent})
+			continue
+		}
+		if held {
+			p.statuses.added(&j, StateWaiting)
+			continue
+		}
+		queued = append(queued, j)
+	}
+	for _, j := range queued {
+		if j.runAt.After(time.Now()) {
+			p.statuses.added(&j, StateScheduled)
+		} else {
+			p.statuses.added(&j, StateQueued)
+		}
+		p.requeue(j)
+	}
+	for _, f := range failed {
+		p.statuses.added(&f.job, StateWaiting)
+		p.dependencyFailed(f.job, f.parent)
+	}
+	if len(recovered) > 0 {
+		log.Printf("Recovered %d jobs from journal", len(recovered))
+	}
+}
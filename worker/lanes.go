@@ -0,0 +1,159 @@
+package worker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Priority selects the lane of the queue, jobs of higher lanes are dispatched first.
+type Priority int
+
+const (
+	PriorityLow Priority = iota - 1
+	PriorityNormal
+	PriorityHigh
+
+	lanesCount = 3
+)
+
+// Lower lane with jobs is served after it was passed over this many times in a row,
+// so a flood of high priority jobs does not stop everything else.
+const starvationLimit = 16
+
+var priorityNames = [lanesCount]string{"low", "normal", "high"}
+
+// Priorities lists all priorities from the highest.
+var Priorities = []Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+func ParsePriority(s string) (Priority, error) {
+	for i, name := range priorityNames {
+		if name == s {
+			return Priority(i) + PriorityLow, nil
+		}
+	}
+	return PriorityNormal, fmt.Errorf("unknown priority %s", s)
+}
+
+func (p Priority) String() string {
+	if p < PriorityLow || p > PriorityHigh {
+		return strconv.Itoa(int(p))
+	}
+	return priorityNames[p.lane()]
+}
+
+func (p Priority) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Priority) UnmarshalText(b []byte) error {
+	var err error
+	*p, err = ParsePriority(string(b))
+	return err
+}
+
+func (p Priority) lane() int {
+	return int(p - PriorityLow)
+}
+
+// ParseLaneSizes parses capacities of lanes like "high=1000,low=50000".
+func ParseLaneSizes(s string) (map[Priority]int, error) {
+	sizes := make(map[Priority]int)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, size, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid lane size %s", part)
+		}
+		priority, err := ParsePriority(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		if sizes[priority], err = strconv.Atoi(strings.TrimSpace(size)); err != nil || sizes[priority] <= 0 {
+			return nil, fmt.Errorf("invalid lane size %s", part)
+		}
+	}
+	return sizes, nil
+}
+
+// lanes is the shard of the queue, its jobs are split by priority.
+type lanes struct {
+	queues [lanesCount]chan job
+	// How many times in a row the lane with jobs was passed over
+	skipped [lanesCount]int32
+}
+
+func newLanes(size int, sizes map[Priority]int) *lanes {
+	l := &lanes{}
+	for i := range l.queues {
+		laneSize := size
+		if s, ok := sizes[Priority(i)+PriorityLow]; ok {
+			laneSize = s
+		}
+		l.queues[i] = make(chan job, laneSize)
+	}
+	return l
+}
+
+func (l *lanes) queue(p Priority) chan job {
+	return l.queues[p.lane()]
+}
+
+// offer puts the job to its lane if there is room.
+func (l *lanes) offer(j job) bool {
+	select {
+	case l.queue(j.priority) <- j:
+		return true
+	default:
+		return false
+	}
+}
+
+// push puts the job to its lane, it blocks while the lane is full.
+func (l *lanes) push(j job) {
+	l.queue(j.priority) <- j
+}
+
+// room returns how many jobs can be put to the lane of the priority.
+func (l *lanes) room(p Priority) int {
+	q := l.queue(p)
+	return cap(q) - len(q)
+}
+
+// popStarved takes the job from the lower lane which was passed over too many times.
+func (l *lanes) popStarved() (job, bool) {
+	for i := lanesCount - 1; i >= 0; i-- {
+		if atomic.LoadInt32(&l.skipped[i]) < starvationLimit {
+			continue
+		}
+		if j, ok := l.pollLane(i); ok {
+			return j, true
+		}
+		atomic.StoreInt32(&l.skipped[i], 0)
+	}
+	return job{}, false
+}
+
+// pollLane takes the job from the lane without blocking.
+func (l *lanes) pollLane(lane int) (job, bool) {
+	select {
+	case j := <-l.queues[lane]:
+		l.served(lane)
+		return j, true
+	default:
+		return job{}, false
+	}
+}
+
+func (l *lanes) served(lane int) {
+	atomic.StoreInt32(&l.skipped[lane], 0)
+	for i := 0; i < lane; i++ {
+		if len(l.queues[i]) > 0 {
+			atomic.AddInt32(&l.skipped[i], 1)
+		}
+	}
+}
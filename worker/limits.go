@@ -0,0 +1,243 @@
+package worker
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/ReneKroon/ttlcache/v2"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// MaxConcurrency limits amount of simultaneously running jobs of the action.
+func MaxConcurrency(n int) ActionOption {
+	return func(a *action) {
+		a.maxConcurrency = n
+	}
+}
+
+// ConcurrencyKey adds one more concurrency limit shared by jobs with the same key,
+// like the destination host. fn returns an empty key or max <= 0 for unlimited jobs.
+func ConcurrencyKey(fn func(data any) (key string, max int)) ActionOption {
+	return func(a *action) {
+		a.concurrencyKey = fn
+	}
+}
+
+type limitKey struct {
+	name string
+	max  int
+}
+
+type limitSlot struct {
+	max     int
+	running int
+	// Jobs waiting for a free slot, they do not occupy workers and queue
+	waiting *list.List
+}
+
+// limiter keeps jobs which exceed concurrency limits until running jobs with the same keys finish.
+type limiter struct {
+	mu      sync.Mutex
+	slots   map[string]*limitSlot
+	waiting int
+	metrics *ttlcache.Cache
+}
+
+func newLimiter() *limiter {
+	l := &limiter{
+		slots:   make(map[string]*limitSlot),
+		metrics: ttlcache.NewCache(),
+	}
+	// Gauges of unused keys are removed after an hour
+	_ = l.metrics.SetTTL(time.Hour)
+	l.metrics.SetExpirationCallback(func(key string, _ any) {
+		metrics.UnregisterMetric(limitedJobsMetric(key))
+	})
+	return l
+}
+
+func limitedJobsMetric(key string) string {
+	return `limited_jobs{key="` + key + `"}`
+}
+
+// limitKeys returns concurrency limits of the job.
+func (p *Pool) limitKeys(j *job) []limitKey {
+	a, ok := p.actions[j.action]
+	if !ok {
+		return nil
+	}
+	var keys []limitKey
+	if a.maxConcurrency > 0 {
+		keys = append(keys, limitKey{name: "action:" + j.action, max: a.maxConcurrency})
+	}
+	if a.concurrencyKey != nil {
+		if name, max := a.concurrencyKey(j.data); name != "" && max > 0 {
+			keys = append(keys, limitKey{name: j.action + ":" + name, max: max})
+		}
+	}
+	return keys
+}
+
+// acquire takes slots of all limits of the job. If any limit is reached, the job is
+// kept until a slot is freed and false is returned.
+func (l *limiter) acquire(j *job) bool {
+	if j.holdsSlots || len(j.limitKeys) == 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if full := l.fullSlot(j.limitKeys); full != nil {
+		l.wait(full, j)
+		return false
+	}
+	l.take(j)
+	return true
+}
+
+func (l *limiter) slot(key limitKey) *limitSlot {
+	s, ok := l.slots[key.name]
+	if !ok {
+		s = &limitSlot{waiting: list.New()}
+		l.slots[key.name] = s
+	}
+	// The limit can be changed by the configuration of the key
+	s.max = key.max
+	return s
+}
+
+// fullSlot returns the first slot which does not allow one more job.
+func (l *limiter) fullSlot(keys []limitKey) *limitSlot {
+	for _, key := range keys {
+		if s := l.slot(key); s.running >= s.max {
+			return s
+		}
+	}
+	return nil
+}
+
+func (l *limiter) take(j *job) {
+	for _, key := range j.limitKeys {
+		l.slots[key.name].running++
+	}
+	j.holdsSlots = true
+}
+
+func (l *limiter) wait(s *limitSlot, j *job) {
+	s.waiting.PushBack(*j)
+	l.waiting++
+	for _, key := range j.limitKeys {
+		if l.slots[key.name] == s {
+			if _, err := l.metrics.Get(key.name); err == ttlcache.ErrNotFound {
+				_ = l.metrics.Set(key.name, nil)
+				metrics.GetOrCreateGauge(limitedJobsMetric(key.name), func() float64 {
+					return float64(l.waitingFor(key.name))
+				})
+			}
+			break
+		}
+	}
+	l.cleanup(j.limitKeys)
+}
+
+func (l *limiter) waitingFor(name string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s, ok := l.slots[name]; ok {
+		return s.waiting.Len()
+	}
+	return 0
+}
+
+// release frees slots of the job and returns waiting jobs which got the slots.
+func (l *limiter) release(j *job) []job {
+	if !j.holdsSlots {
+		return nil
+	}
+	j.holdsSlots = false
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var ready []job
+	for _, key := range j.limitKeys {
+		s := l.slots[key.name]
+		s.running--
+		for s.running < s.max && s.waiting.Len() > 0 {
+			w := s.waiting.Remove(s.waiting.Front()).(job)
+			l.waiting--
+			if full := l.fullSlot(w.limitKeys); full != nil {
+				// Another limit of the job is reached
+				l.wait(full, &w)
+				continue
+			}
+			l.take(&w)
+			ready = append(ready, w)
+		}
+	}
+	l.cleanup(j.limitKeys)
+	return ready
+}
+
+// forget frees slots of the job which left the pool, waiting jobs are not started.
+func (l *limiter) forget(j *job) {
+	if !j.holdsSlots {
+		return
+	}
+	j.holdsSlots = false
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range j.limitKeys {
+		l.slots[key.name].running--
+	}
+	l.cleanup(j.limitKeys)
+}
+
+// remove takes the waiting job out of the limiter.
+func (l *limiter) remove(id uint64) (job, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range l.slots {
+		for e := s.waiting.Front(); e != nil; e = e.Next() {
+			if j := e.Value.(job); j.id == id {
+				s.waiting.Remove(e)
+				l.waiting--
+				l.cleanup(j.limitKeys)
+				return j, true
+			}
+		}
+	}
+	return job{}, false
+}
+
+// drain removes all waiting jobs.
+func (l *limiter) drain() []job {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var jobs []job
+	for name, s := range l.slots {
+		for e := s.waiting.Front(); e != nil; e = e.Next() {
+			jobs = append(jobs, e.Value.(job))
+		}
+		s.waiting.Init()
+		if s.running == 0 {
+			delete(l.slots, name)
+		}
+	}
+	l.waiting = 0
+	return jobs
+}
+
+// cleanup removes unused slots, so keys like hosts do not pile up.
+func (l *limiter) cleanup(keys []limitKey) {
+	for _, key := range keys {
+		if s, ok := l.slots[key.name]; ok && s.running == 0 && s.waiting.Len() == 0 {
+			delete(l.slots, key.name)
+		}
+	}
+}
+
+// len returns amount of waiting jobs.
+func (l *limiter) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.waiting
+}
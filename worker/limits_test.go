@@ -0,0 +1,39 @@
+package worker
+
+import "testing"
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter()
+	keys := []limitKey{{name: "action:http", max: 2}, {name: "http:example.com", max: 1}}
+	other := []limitKey{{name: "action:http", max: 2}, {name: "http:example.org", max: 1}}
+	jobs := []job{
+		{id: 1, limitKeys: keys},
+		{id: 2, limitKeys: keys},
+		{id: 3, limitKeys: other},
+		{id: 4, limitKeys: other},
+	}
+	for i := range jobs {
+		acquired := l.acquire(&jobs[i])
+		if acquired != (i == 0 || i == 2) {
+			t.Fatalf("Job %d acquired: %v", jobs[i].id, acquired)
+		}
+	}
+	if l.len() != 2 {
+		t.Fatalf("Expected 2 waiting jobs, got %d", l.len())
+	}
+
+	ready := l.release(&jobs[0])
+	if len(ready) != 1 || ready[0].id != 2 || !ready[0].holdsSlots {
+		t.Fatalf("Job 2 must get the slot, got %v", ready)
+	}
+	second := ready[0]
+	ready = l.release(&jobs[2])
+	if len(ready) != 1 || ready[0].id != 4 {
+		t.Fatalf("Job 4 must get the slot, got %v", ready)
+	}
+	l.release(&ready[0])
+	l.forget(&second)
+	if l.len() != 0 || len(l.slots) != 0 {
+		t.Errorf("All slots must be freed, got %d", len(l.slots))
+	}
+}
@@ -0,0 +1,152 @@
+package worker
+
+import (
+	"sync"
+	"time"
+)
+
+// OrderingKey runs jobs of the same action with the key strictly one after another in the order
+// they were added. A job blocks later jobs with its key until it is finished, including retries.
+func OrderingKey(key string) JobOption {
+	return func(j *job) {
+		j.orderingKey = key
+	}
+}
+
+// sequencer keeps the order of jobs with ordering keys. Only the first job of the key may run,
+// later jobs taken from the queue are parked until it is finished.
+type sequencer struct {
+	mu   sync.Mutex
+	keys map[string]*sequence
+}
+
+type sequence struct {
+	// Ids of admitted jobs in order, the first one runs
+	ids    []uint64
+	parked map[uint64]job
+}
+
+func newSequencer() *sequencer {
+	return &sequencer{
+		keys: make(map[string]*sequence),
+	}
+}
+
+// add puts the admitted job to the end of its sequence.
+func (s *sequencer) add(j *job) {
+	if j.orderingKey == "" {
+		return
+	}
+	key := j.action + ":" + j.orderingKey
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seq, ok := s.keys[key]
+	if !ok {
+		seq = &sequence{parked: make(map[uint64]job)}
+		s.keys[key] = seq
+	}
+	seq.ids = append(seq.ids, j.id)
+}
+
+// acquire returns true if the job may run, otherwise the job is parked.
+func (s *sequencer) acquire(j *job) bool {
+	if j.orderingKey == "" {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seq, ok := s.keys[j.action+":"+j.orderingKey]
+	if !ok || seq.ids[0] == j.id {
+		return true
+	}
+	seq.parked[j.id] = *j
+	return false
+}
+
+// isHead returns true if the job has no ordering key or is the first one of its sequence.
+func (s *sequencer) isHead(j *job) bool {
+	if j.orderingKey == "" {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seq, ok := s.keys[j.action+":"+j.orderingKey]
+	return !ok || seq.ids[0] == j.id
+}
+
+// done removes the finished or dropped job from its sequence and returns the next job
+// if it is parked and may run now.
+func (s *sequencer) done(j *job) (job, bool) {
+	if j.orderingKey == "" {
+		return job{}, false
+	}
+	key := j.action + ":" + j.orderingKey
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seq, ok := s.keys[key]
+	if !ok {
+		return job{}, false
+	}
+	for i, id := range seq.ids {
+		if id == j.id {
+			seq.ids = append(seq.ids[:i], seq.ids[i+1:]...)
+			break
+		}
+	}
+	if len(seq.ids) == 0 {
+		delete(s.keys, key)
+		return job{}, false
+	}
+	next, ok := seq.parked[seq.ids[0]]
+	if ok {
+		delete(seq.parked, next.id)
+	}
+	return next, ok
+}
+
+// remove takes the parked job out of its sequence's parking, the job stays in the sequence
+// until it is done.
+func (s *sequencer) remove(id uint64) (job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, seq := range s.keys {
+		if j, ok := seq.parked[id]; ok {
+			delete(seq.parked, id)
+			return j, true
+		}
+	}
+	return job{}, false
+}
+
+// drain removes all parked jobs, they stay in their sequences.
+func (s *sequencer) drain() []job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var jobs []job
+	for _, seq := range s.keys {
+		for id, j := range seq.parked {
+			jobs = append(jobs, j)
+			delete(seq.parked, id)
+		}
+	}
+	return jobs
+}
+
+// len returns amount of parked jobs.
+func (s *sequencer) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, seq := range s.keys {
+		n += len(seq.parked)
+	}
+	return n
+}
+
+// sequenceDone removes the job from its sequence and moves the next parked job to the queue.
+func (p *Pool) sequenceDone(j *job) {
+	if next, ok := p.sequencer.done(j); ok {
+		// Do not block the caller, the scheduler moves jobs to the queue
+		p.scheduler.add(next, time.Now())
+	}
+}
@@ -0,0 +1,41 @@
+package worker
+
+import "testing"
+
+func TestSequencer(t *testing.T) {
+	s := newSequencer()
+	jobs := []job{
+		{id: 1, action: "test", orderingKey: "a"},
+		{id: 2, action: "test", orderingKey: "a"},
+		{id: 3, action: "test", orderingKey: "b"},
+		{id: 4, action: "test", orderingKey: "a"},
+	}
+	for i := range jobs {
+		s.add(&jobs[i])
+	}
+	if s.acquire(&jobs[1]) || s.acquire(&jobs[3]) {
+		t.Fatal("Later jobs must be parked")
+	}
+	if !s.acquire(&jobs[0]) || !s.acquire(&jobs[2]) {
+		t.Fatal("The first jobs of keys must run")
+	}
+	if s.len() != 2 {
+		t.Fatalf("Expected 2 parked jobs, got %d", s.len())
+	}
+
+	// A retry of the first job keeps its place
+	if !s.acquire(&jobs[0]) {
+		t.Fatal("The retry of the first job must run")
+	}
+	next, ok := s.done(&jobs[0])
+	if !ok || next.id != 2 {
+		t.Fatalf("Job 2 must be next, got %v", next)
+	}
+	next, ok = s.done(&next)
+	if !ok || next.id != 4 {
+		t.Fatalf("Job 4 must be next, got %v", next)
+	}
+	if _, ok = s.done(&next); ok || s.len() != 0 {
+		t.Error("The sequence must be empty")
+	}
+}
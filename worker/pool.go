@@ -2,101 +2,498 @@ package worker
 
 import (
 	"container/list"
+	"context"
 	"errors"
 	"log"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
-	ErrPoolClosed = errors.New("pool is closed")
-	ErrQueueFull  = errors.New("queue is full")
+	ErrPoolClosed   = errors.New("pool is closed")
+	ErrQueueFull    = errors.New("queue is full")
+	ErrScheduleFull = errors.New("too many scheduled jobs")
+
+	ErrInvalidDependency = errors.New("job depends on a later job of the batch")
+
+	errInvalidSize = errors.New("pool size must be positive")
 )
 
 type Pool struct {
-	// Amount of workers in pool
+	// Amount of workers in pool, use Resize to change it after start
 	Size int
-	// Amount of jobs that can be in queue
+	// Amount of jobs that can be in the queue of each priority
 	QueueSize int
+	// Amount of queue shards, GOMAXPROCS by default. Every worker takes jobs from its own shard
+	// first, so workers of different shards do not contend.
+	Shards int
+	// Optional capacities of lanes which differ from QueueSize
+	LaneSizes map[Priority]int
+	// Amount of delayed jobs, retries and jobs waiting for dependencies outside the queue
+	ScheduleSize int
+	// Optional persistent storage of queued jobs. Only jobs of actions with
+	// a registered codec are journaled.
+	Journal Journal
+	// Optional storage of finally failed jobs. Only jobs of actions with
+	// a registered codec are saved.
+	DeadLetters *DeadLetterQueue
+	// Max amount of job statuses to keep, 0 disables statuses
+	StatusLimit int
+	// How long the status is kept after the last update
+	StatusTTL time.Duration
+	// How long idempotency keys of jobs are remembered, 0 disables deduplication
+	IdempotencyWindow time.Duration
+	// Max amount of remembered idempotency keys
+	IdempotencyLimit int
 
-	handlers    map[string]JobHandler
-	finish      bool
-	jobsQueue   chan job
-	freeWorkers chan *worker
-	workers     *list.List
+	actions  map[string]*action
+	codecs   map[string]Codec
+	decoders map[string]Decoder
+	lastID   uint64
+	finish   bool
+	// Serializes capacity checks of new jobs, so batches are admitted atomically
+	admission sync.Mutex
+	// Amount of started and not yet finished jobs, including async ones
+	running int32
+	// Total wait in nanoseconds and amount of jobs taken from the queue, the autoscaler reads them
+	waitSum   int64
+	waitCount int64
+	// Guards workers and Size after start
+	resize sync.Mutex
+	// Guards the autoscaler and its decisions
+	scaling    sync.Mutex
+	autoscaler *autoscaler
+	decisions  []ScaleDecision
+	// Parent of contexts of all attempts, it is cancelled when Finish times out
+	ctx       context.Context
+	cancel    context.CancelFunc
+	attempts  *attempts
+	canceller *canceller
+	// Ids of jobs recently received by handoffs with the time of receipt, guarded by handoffMu
+	handoffMu sync.Mutex
+	handedIn  map[uint64]time.Time
+	// Amount of jobs left in the journal and dropped on finish
+	kept         int32
+	dropped      int32
+	jobsQueue    *queue
+	workers      *list.List
+	statuses     *statusStore
+	idempotency  *idempotencyStore
+	coalescer    *coalescer
+	sequencer    *sequencer
+	dependencies *dependencies
+	scheduler    *scheduler
+	limiter      *limiter
 }
 
 type job struct {
-	action string
-	data   any
+	id       uint64
+	action   string
+	data     any
+	priority Priority
+	// Job must not be started before this time
+	runAt time.Time
+	// Amount of started attempts
+	attempts int
+	queued   time.Time
+	started  time.Time
+	// When the job was put to the queue last time
+	pushed time.Time
+	// Job has the add record in the journal
+	journaled bool
+	// Not persisted, keys are remembered only by the process which queued the job
+	idempotencyKey string
+	coalesceKey    string
+	coalesceMode   CoalesceMode
+	coalesceWindow time.Duration
+	// Persisted, jobs recovered from the journal or handed off keep their order
+	orderingKey string
+	// Persisted, ids of jobs which must succeed before the job runs
+	dependsOn []uint64
+	// Persisted, max duration of every attempt
+	timeout time.Duration
+	// Persisted, the job can be cancelled by any of them
+	tags []string
+	// Concurrency limits of the job, computed on the first dispatch
+	limitKeys  []limitKey
+	holdsSlots bool
+}
+
+// JobHandler runs the attempt of the job. The context is cancelled when the timeout of the job
+// expires or the pool is interrupted on finish, GetJobInfo returns the job of the context.
+type JobHandler = func(ctx context.Context, data any) error
+
+// AsyncJobHandler starts the job and returns without waiting for it. The done function must be
+// called exactly once with the result of the attempt, it may be called from any goroutine.
+// The context is valid until done is called.
+type AsyncJobHandler = func(ctx context.Context, data any, done func(error))
+
+// ActionOption configures the registered action.
+type ActionOption func(a *action)
+
+type action struct {
+	handler JobHandler
+	async   AsyncJobHandler
+	// Semaphore of async jobs in flight
+	inFlight       chan struct{}
+	maxConcurrency int
+	concurrencyKey func(data any) (string, int)
+	onFinish       []FinishHook
+}
+
+// JobOption changes how the job is queued.
+type JobOption func(j *job)
+
+// RunAt delays the job until the time. The job does not occupy the queue while waiting.
+func RunAt(t time.Time) JobOption {
+	return func(j *job) {
+		j.runAt = t
+	}
+}
+
+// Delay delays the job for the duration.
+func Delay(d time.Duration) JobOption {
+	return RunAt(time.Now().Add(d))
+}
+
+// WithPriority puts the job to the lane of the priority.
+func WithPriority(priority Priority) JobOption {
+	return func(j *job) {
+		if priority < PriorityLow {
+			priority = PriorityLow
+		} else if priority > PriorityHigh {
+			priority = PriorityHigh
+		}
+		j.priority = priority
+	}
+}
+
+// Journal stores queued jobs, so they can be replayed after a crash.
+type Journal interface {
+	Append(id uint64, action string, payload []byte) error
+	Done(id uint64) error
+	Recover(fn func(id uint64, action string, payload []byte) error) error
+	Close() error
 }
 
-type JobHandler = func(any) error
+// Codec converts job data of an action to json and back.
+type Codec interface {
+	Marshal(data any) ([]byte, error)
+	Unmarshal(b []byte) (any, error)
+}
 
 func (p *Pool) Init() {
-	p.handlers = make(map[string]JobHandler)
-	p.jobsQueue = make(chan job, p.QueueSize)
-	p.freeWorkers = make(chan *worker, p.Size)
+	p.actions = make(map[string]*action)
+	p.codecs = make(map[string]Codec)
+	p.decoders = make(map[string]Decoder)
+	shards := p.Shards
+	if shards <= 0 {
+		shards = runtime.GOMAXPROCS(0)
+	}
+	p.jobsQueue = newQueue(shards, p.Size, p.QueueSize, p.LaneSizes)
 	p.workers = list.New()
+	p.scheduler = newScheduler(p)
+	p.limiter = newLimiter()
+	p.coalescer = newCoalescer()
+	p.sequencer = newSequencer()
+	p.dependencies = newDependencies()
+	p.attempts = newAttempts()
+	p.canceller = newCanceller()
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	if p.StatusLimit > 0 {
+		p.statuses = newStatusStore(p.StatusTTL, p.StatusLimit)
+	}
+	if p.IdempotencyWindow > 0 {
+		p.idempotency = newIdempotencyStore(p.IdempotencyWindow, p.IdempotencyLimit)
+	}
+	// Ids are seeded with the current time, so they stay unique across restarts
+	p.lastID = uint64(time.Now().UnixNano())
 }
 
 func (p *Pool) Start() {
-	for i := 0; i < p.Size; i++ {
-		w := &worker{
-			pool: p,
-		}
-		p.workers.PushFront(w)
-		w.start()
+	// Workers dispatch jobs themselves, there is no dispatcher between the queue and workers
+	p.resize.Lock()
+	for p.workers.Len() < p.Size {
+		p.startWorker()
 	}
+	p.resize.Unlock()
+	go p.scheduler.run()
 
-	go func() {
-		for job := range p.jobsQueue {
-			// Wait for the free worker
-			w := <-p.freeWorkers
+	if p.Journal != nil {
+		p.replayJournal()
+		go func() {
+			// Picks up the journal of the previous process after it exits
+			for range time.Tick(journalRecoverInterval) {
+				p.replayJournal()
+			}
+		}()
+	}
+}
 
-			// Send job to worker
-			w.jobsChan <- job
-		}
-	}()
+// Resize changes amount of workers of the started pool. New workers start at once, retired
+// workers finish their current jobs first. Queued jobs are not affected, workers of every
+// shard take jobs from other shards too.
+func (p *Pool) Resize(size int) error {
+	if size < 1 {
+		return errInvalidSize
+	}
+	p.resize.Lock()
+	defer p.resize.Unlock()
+	if p.finish {
+		return ErrPoolClosed
+	}
+	for p.workers.Len() < size {
+		p.startWorker()
+	}
+	for p.workers.Len() > size {
+		w := p.workers.Remove(p.workers.Back()).(*worker)
+		// Nobody waits for retired workers
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		w.quit <- wg
+	}
+	p.Size = size
+	return nil
+}
+
+func (p *Pool) startWorker() {
+	w := &worker{
+		pool:  p,
+		shard: p.jobsQueue.shard(p.workers.Len()),
+	}
+	p.workers.PushBack(w)
+	w.start()
+}
+
+func (p *Pool) RegisterAction(name string, handler JobHandler, opts ...ActionOption) {
+	a := &action{
+		handler: handler,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	p.actions[name] = a
+}
+
+// RegisterAsyncAction registers the action whose jobs do not occupy workers while running.
+// At most inFlight jobs of the action run at once, workers wait for the budget when it is spent.
+func (p *Pool) RegisterAsyncAction(name string, handler AsyncJobHandler, inFlight int, opts ...ActionOption) {
+	a := &action{
+		async:    handler,
+		inFlight: make(chan struct{}, inFlight),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	p.actions[name] = a
+}
+
+// RegisterCodec makes jobs of the action persistable.
+func (p *Pool) RegisterCodec(action string, codec Codec) {
+	p.codecs[action] = codec
 }
 
-func (p *Pool) RegisterAction(action string, handler JobHandler) {
-	p.handlers[action] = handler
+// GetCodec returns the codec of the action or nil if the action has no codec.
+func (p *Pool) GetCodec(action string) Codec {
+	return p.codecs[action]
 }
 
-func (p *Pool) AddJob(action string, data any) error {
+// AddJob puts the job to the queue and returns its id.
+func (p *Pool) AddJob(action string, data any, opts ...JobOption) (uint64, error) {
 	if p.finish {
-		return ErrPoolClosed
+		return 0, ErrPoolClosed
 	}
-	select {
-	case p.jobsQueue <- job{
+	j := job{
+		id:     atomic.AddUint64(&p.lastID, 1),
 		action: action,
 		data:   data,
-	}:
-	default:
+	}
+	for _, opt := range opts {
+		opt(&j)
+	}
+	if (j.idempotencyKey != "" && p.idempotency != nil) || j.coalesceKey != "" || len(j.dependsOn) > 0 {
+		ids, err := p.AddJobs(action, []NewJob{{Data: data, Options: opts}})
+		if err != nil {
+			return 0, err
+		}
+		return ids[0], nil
+	}
+	return j.id, p.enqueue(j)
+}
+
+func (p *Pool) enqueue(j job) error {
+	p.admission.Lock()
+	defer p.admission.Unlock()
+	j.queued = time.Now()
+	if j.runAt.After(time.Now()) {
+		if p.scheduler.len()+p.dependencies.len() >= p.ScheduleSize {
+			return ErrScheduleFull
+		}
+		if err := p.journalAppend(&j); err != nil {
+			return err
+		}
+		p.sequencer.add(&j)
+		p.canceller.add(&j)
+		p.statuses.added(&j, StateScheduled)
+		p.scheduler.add(j, j.runAt)
+		return nil
+	}
+	if p.jobsQueue.full(j.priority) {
+		return ErrQueueFull
+	}
+	if err := p.journalAppend(&j); err != nil {
+		return err
+	}
+	p.sequencer.add(&j)
+	p.canceller.add(&j)
+	p.statuses.added(&j, StateQueued)
+	if !p.jobsQueue.offer(j) {
+		p.sequencer.done(&j)
+		p.canceller.done(&j)
+		p.statuses.remove(j.id)
+		p.journalDone(j)
 		return ErrQueueFull
 	}
 	return nil
 }
 
+// requeue puts back the job which was taken from the queue or the scheduler.
+// It blocks while the queue is full.
+func (p *Pool) requeue(j job) {
+	if j.runAt.After(time.Now()) {
+		p.scheduler.add(j, j.runAt)
+	} else {
+		p.jobsQueue.push(j)
+	}
+}
+
+// GetQueueLength returns amount of queued jobs in all lanes.
 func (p *Pool) GetQueueLength() int {
-	return len(p.jobsQueue)
+	return p.jobsQueue.len()
+}
+
+// GetLaneLength returns amount of queued jobs with the priority.
+func (p *Pool) GetLaneLength(priority Priority) int {
+	return p.jobsQueue.laneLen(priority)
+}
+
+// GetScheduledJobs returns amount of delayed jobs and jobs waiting for the next attempt.
+func (p *Pool) GetScheduledJobs() int {
+	return p.scheduler.len()
+}
+
+// GetSize returns amount of workers.
+func (p *Pool) GetSize() int {
+	p.resize.Lock()
+	defer p.resize.Unlock()
+	return p.workers.Len()
 }
 
 func (p *Pool) GetActiveWorkers() int {
-	return p.Size - len(p.freeWorkers)
+	return p.jobsQueue.busyWorkers()
+}
+
+// GetRunningJobs returns amount of running jobs, including jobs of async actions in flight.
+func (p *Pool) GetRunningJobs() int {
+	return int(atomic.LoadInt32(&p.running))
+}
+
+// GetInFlightJobs returns amount of running jobs of async actions.
+func (p *Pool) GetInFlightJobs() int {
+	n := 0
+	for _, a := range p.actions {
+		n += len(a.inFlight)
+	}
+	return n
+}
+
+// GetLimitedJobs returns amount of jobs waiting for concurrency limits.
+func (p *Pool) GetLimitedJobs() int {
+	return p.limiter.len()
+}
+
+// GetOrderedJobs returns amount of jobs waiting for previous jobs with their ordering keys.
+func (p *Pool) GetOrderedJobs() int {
+	return p.sequencer.len()
+}
+
+// GetWaitingJobs returns amount of jobs waiting for their dependencies.
+func (p *Pool) GetWaitingJobs() int {
+	return p.dependencies.len()
+}
+
+// GetJobStatus returns the status of a recent job.
+func (p *Pool) GetJobStatus(id uint64) (JobStatus, bool) {
+	return p.statuses.get(id)
 }
 
-func (p *Pool) Finish() {
+// Finish waits for all jobs except delayed ones and stops workers. With a positive timeout,
+// attempts still running after it are cancelled and jobs which are not started are left:
+// journaled jobs stay in the journal until the next start, others are dropped.
+func (p *Pool) Finish(timeout time.Duration) {
 	log.Println("Finishing all jobs...")
 	p.finish = true
-	for len(p.jobsQueue) != 0 {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	interrupted := false
+	for {
+		// Retries are left in the scheduler and run on time
+		for _, delayed := range p.scheduler.drainDelayed() {
+			// Dependents of the dropped job are dropped too
+			for _, j := range append([]job{delayed}, p.dependencies.drop(delayed.id)...) {
+				// Later jobs with the same ordering key must not wait for the dropped one
+				p.sequenceDone(&j)
+				if !j.journaled {
+					log.Printf("%s %d is not due yet and dropped", j.action, j.id)
+				}
+				p.abandon(&j)
+			}
+		}
+		if p.jobsQueue.len() == 0 && p.GetActiveWorkers() == 0 && p.GetRunningJobs() == 0 &&
+			p.scheduler.len() == 0 && p.limiter.len() == 0 && p.sequencer.len() == 0 &&
+			p.dependencies.len() == 0 {
+			break
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			log.Printf("Jobs are not finished in %s", timeout)
+			p.interrupt()
+			interrupted = true
+			break
+		}
 		time.Sleep(50 * time.Millisecond)
 	}
+	p.Autoscale(nil)
+	p.resize.Lock()
 	wg := &sync.WaitGroup{}
-	wg.Add(p.Size)
+	wg.Add(p.workers.Len())
 	for e := p.workers.Front(); e != nil; e = e.Next() {
 		e.Value.(*worker).quit <- wg
 	}
-	wg.Wait()
+	p.resize.Unlock()
+	if interrupted {
+		p.waitInterrupted(wg)
+		p.abandonPending()
+	} else {
+		wg.Wait()
+	}
+	if kept := atomic.LoadInt32(&p.kept); kept > 0 {
+		log.Printf("%d jobs are kept in the journal", kept)
+	}
+	if dropped := atomic.LoadInt32(&p.dropped); dropped > 0 {
+		log.Printf("%d jobs are dropped", dropped)
+	}
+	if p.DeadLetters != nil {
+		if err := p.DeadLetters.Flush(); err != nil {
+			log.Printf("Could not save dead letters: %s", err.Error())
+		}
+	}
+	if p.Journal != nil {
+		if err := p.Journal.Close(); err != nil {
+			log.Printf("Could not close journal: %s", err.Error())
+		}
+	}
 }
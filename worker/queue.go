@@ -0,0 +1,229 @@
+package worker
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// queue is the queue of jobs split into shards of lanes, so workers of different shards do not
+// contend for the same channels. Workers take jobs from their own shard first and steal jobs
+// from other shards, so a job never waits while any worker is idle. Higher lanes are served
+// first across all shards.
+type queue struct {
+	shards []*lanes
+	// Round robin counter of new jobs
+	next uint32
+	// Amount of workers waiting for jobs
+	idle int32
+	// Amount of jobs put and not taken yet. It drops after busy grows, so a job handed over
+	// to a worker is always counted in one of them.
+	size int32
+	// Amount of workers which took jobs and did not finish them
+	busy int32
+	// Wakes up idle workers of other shards when a job is put
+	wake chan struct{}
+}
+
+// newQueue splits capacities of lanes between shards. Every shard keeps at least one job of every lane.
+func newQueue(shards, workers, size int, sizes map[Priority]int) *queue {
+	var capacities [lanesCount]int
+	for i := range capacities {
+		capacities[i] = size
+		if s, ok := sizes[Priority(i)+PriorityLow]; ok {
+			capacities[i] = s
+		}
+		if capacities[i] < shards {
+			shards = capacities[i]
+		}
+	}
+	if shards > workers {
+		shards = workers
+	}
+	if shards < 1 {
+		shards = 1
+	}
+	q := &queue{
+		shards: make([]*lanes, shards),
+		wake:   make(chan struct{}, workers),
+	}
+	for n := range q.shards {
+		shardSizes := make(map[Priority]int, lanesCount)
+		for i, c := range capacities {
+			shardSizes[Priority(i)+PriorityLow] = c / shards
+			if n < c%shards {
+				shardSizes[Priority(i)+PriorityLow]++
+			}
+		}
+		q.shards[n] = newLanes(0, shardSizes)
+	}
+	return q
+}
+
+// shard returns the shard of the i-th worker.
+func (q *queue) shard(worker int) int {
+	return worker % len(q.shards)
+}
+
+// offer puts the job to the first shard with room in its lane.
+func (q *queue) offer(j job) bool {
+	j.pushed = time.Now()
+	atomic.AddInt32(&q.size, 1)
+	start := atomic.AddUint32(&q.next, 1)
+	n := uint32(len(q.shards))
+	for i := uint32(0); i < n; i++ {
+		if q.shards[(start+i)%n].offer(j) {
+			q.notify()
+			return true
+		}
+	}
+	atomic.AddInt32(&q.size, -1)
+	return false
+}
+
+// push puts the job to its lane, it blocks while the lane is full in all shards.
+func (q *queue) push(j job) {
+	if q.offer(j) {
+		return
+	}
+	j.pushed = time.Now()
+	atomic.AddInt32(&q.size, 1)
+	q.shards[atomic.AddUint32(&q.next, 1)%uint32(len(q.shards))].push(j)
+	q.notify()
+}
+
+// notify wakes up an idle worker, it may be waiting on another shard.
+func (q *queue) notify() {
+	if atomic.LoadInt32(&q.idle) == 0 {
+		return
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *queue) full(p Priority) bool {
+	return q.room(p) == 0
+}
+
+// room returns how many jobs can be put to the lane of the priority.
+func (q *queue) room(p Priority) int {
+	n := 0
+	for _, l := range q.shards {
+		n += l.room(p)
+	}
+	return n
+}
+
+func (q *queue) len() int {
+	return int(atomic.LoadInt32(&q.size))
+}
+
+// busyWorkers returns amount of workers which took jobs and did not finish them.
+func (q *queue) busyWorkers() int {
+	return int(atomic.LoadInt32(&q.busy))
+}
+
+// taken counts the worker busy before the job leaves the queue.
+func (q *queue) taken() {
+	atomic.AddInt32(&q.busy, 1)
+	atomic.AddInt32(&q.size, -1)
+}
+
+// done is called by the worker when it finished the taken job.
+func (q *queue) done() {
+	atomic.AddInt32(&q.busy, -1)
+}
+
+// laneLen returns amount of jobs with the priority.
+func (q *queue) laneLen(p Priority) int {
+	n := 0
+	for _, l := range q.shards {
+		n += len(l.queue(p))
+	}
+	return n
+}
+
+// poll takes a job from the highest non-empty lane of any shard without blocking, no worker runs it.
+func (q *queue) poll() (job, bool) {
+	j, ok := q.steal(0)
+	if ok {
+		atomic.AddInt32(&q.size, -1)
+	}
+	return j, ok
+}
+
+// tryPop takes the next job for the worker of the shard without blocking. A starving lane
+// of the own shard goes first, then every lane from the highest is checked in the own shard
+// and in other shards.
+func (q *queue) tryPop(shard int) (job, bool) {
+	if j, ok := q.shards[shard].popStarved(); ok {
+		return j, true
+	}
+	return q.steal(shard)
+}
+
+// steal takes a job from the highest non-empty lane starting from the shard.
+func (q *queue) steal(shard int) (job, bool) {
+	n := len(q.shards)
+	for i := lanesCount - 1; i >= 0; i-- {
+		for k := 0; k < n; k++ {
+			if j, ok := q.shards[(shard+k)%n].pollLane(i); ok {
+				return j, true
+			}
+		}
+	}
+	return job{}, false
+}
+
+// take waits for the next job for the worker of the shard and counts the worker busy, the worker
+// calls done when it finished the job. It returns the wait group instead of the job when the worker
+// is asked to quit.
+func (q *queue) take(shard int, quit chan *sync.WaitGroup) (job, *sync.WaitGroup) {
+	j, wg := q.wait(shard, quit)
+	if wg == nil {
+		q.taken()
+	}
+	return j, wg
+}
+
+func (q *queue) wait(shard int, quit chan *sync.WaitGroup) (job, *sync.WaitGroup) {
+	own := q.shards[shard]
+	for {
+		// The worker retired while busy must not take another job
+		select {
+		case wg := <-quit:
+			return job{}, wg
+		default:
+		}
+		if j, ok := q.tryPop(shard); ok {
+			return j, nil
+		}
+		atomic.AddInt32(&q.idle, 1)
+		// The job put after the check above could miss the wakeup
+		if j, ok := q.steal(shard); ok {
+			atomic.AddInt32(&q.idle, -1)
+			return j, nil
+		}
+		select {
+		case j := <-own.queues[2]:
+			atomic.AddInt32(&q.idle, -1)
+			own.served(2)
+			return j, nil
+		case j := <-own.queues[1]:
+			atomic.AddInt32(&q.idle, -1)
+			own.served(1)
+			return j, nil
+		case j := <-own.queues[0]:
+			atomic.AddInt32(&q.idle, -1)
+			own.served(0)
+			return j, nil
+		case <-q.wake:
+			atomic.AddInt32(&q.idle, -1)
+		case wg := <-quit:
+			atomic.AddInt32(&q.idle, -1)
+			return job{}, wg
+		}
+	}
+}
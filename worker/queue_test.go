@@ -0,0 +1,131 @@
+package worker
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestQueue(t *testing.T) {
+	q := newQueue(4, 10, 10, map[Priority]int{PriorityHigh: 2})
+	if len(q.shards) != 2 {
+		t.Fatalf("Every shard must fit a job of every lane, got %d shards", len(q.shards))
+	}
+	if q.room(PriorityNormal) != 10 || q.room(PriorityHigh) != 2 {
+		t.Fatal("Capacities of lanes must be split between shards")
+	}
+	for i := 0; i < 10; i++ {
+		if !q.offer(job{id: uint64(i)}) {
+			t.Fatalf("Job %d must fit into the queue", i)
+		}
+	}
+	if q.offer(job{id: 10}) || !q.full(PriorityNormal) {
+		t.Fatal("The lane must be full in all shards")
+	}
+	q.push(job{id: 11, priority: PriorityHigh})
+	// The high job is in another shard, but it must go first
+	for shard := range q.shards {
+		if len(q.shards[shard].queue(PriorityHigh)) == 0 {
+			if j, _ := q.take(shard, nil); j.id != 11 {
+				t.Fatalf("The worker must steal the high job, got %d", j.id)
+			}
+			break
+		}
+	}
+	if q.laneLen(PriorityNormal) != 10 || q.len() != 10 {
+		t.Errorf("Expected 10 normal jobs, got %d", q.laneLen(PriorityNormal))
+	}
+	if q.busyWorkers() != 1 {
+		t.Errorf("The worker must be busy once it took the job, got %d", q.busyWorkers())
+	}
+	q.done()
+	if j, ok := q.poll(); !ok || q.len() != 9 || q.busyWorkers() != 0 {
+		t.Errorf("The polled job %d must leave the queue without workers", j.id)
+	}
+}
+
+func TestQueuePriorities(t *testing.T) {
+	q := newQueue(1, 1, 100, map[Priority]int{PriorityLow: 10})
+	for i := 0; i < 10; i++ {
+		q.push(job{id: uint64(i), priority: PriorityLow})
+	}
+	if !q.full(PriorityLow) || q.full(PriorityNormal) {
+		t.Fatal("Only the low lane must be full")
+	}
+	for i := 0; i < 50; i++ {
+		q.push(job{id: uint64(100 + i), priority: PriorityHigh})
+	}
+	q.push(job{id: 1000, priority: PriorityNormal})
+
+	var order []Priority
+	for q.len() > 0 {
+		j, _ := q.take(0, nil)
+		q.done()
+		order = append(order, j.priority)
+	}
+	// Lower lanes are served once after starvationLimit jobs of higher lanes
+	for i, p := range order[:starvationLimit+2] {
+		expected := PriorityHigh
+		if i == starvationLimit {
+			expected = PriorityNormal
+		} else if i == starvationLimit+1 {
+			expected = PriorityLow
+		}
+		if p != expected {
+			t.Fatalf("Job %d must be %s, got %s", i, expected, p)
+		}
+	}
+	if order[len(order)-1] != PriorityLow {
+		t.Errorf("The last job must be low")
+	}
+}
+
+// BenchmarkDispatch compares the queue of one shard, which all workers share, with the
+// queue sharded by default.
+func BenchmarkDispatch(b *testing.B) {
+	for _, size := range []int{8, 64, 512} {
+		b.Run("single/"+strconv.Itoa(size), func(b *testing.B) {
+			benchmarkDispatch(b, size, 1)
+		})
+		b.Run("sharded/"+strconv.Itoa(size), func(b *testing.B) {
+			benchmarkDispatch(b, size, 0)
+		})
+	}
+}
+
+func benchmarkDispatch(b *testing.B, size, shards int) {
+	p := &Pool{Size: size, Shards: shards, QueueSize: 10000, ScheduleSize: 1}
+	p.Init()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	left := int64(b.N)
+	done := make(chan struct{})
+	p.RegisterAction("noop", func(context.Context, any) error {
+		return nil
+	}, OnFinish(func(*JobResult, any) {
+		if atomic.AddInt64(&left, -1) == 0 {
+			close(done)
+		}
+	}))
+	p.Start()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			for {
+				if _, err := p.AddJob("noop", nil); err == nil {
+					break
+				}
+				runtime.Gosched()
+			}
+		}
+	})
+	<-done
+	b.StopTimer()
+	p.Finish(0)
+}
@@ -0,0 +1,193 @@
+package worker
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RetryError asks the pool to run the job again after the delay.
+// The job does not hold a worker or a queue slot while waiting.
+type RetryError struct {
+	Err   error
+	Delay time.Duration
+}
+
+func (e *RetryError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("postponed for %v", e.Delay)
+	}
+	return fmt.Sprintf("%s, retry in %v", e.Err.Error(), e.Delay)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// Retry wraps the error of a failed attempt, so the job is retried after the delay.
+func Retry(err error, delay time.Duration) error {
+	return &RetryError{
+		Err:   err,
+		Delay: delay,
+	}
+}
+
+// Postpone runs the job again after the delay without counting the attempt,
+// like when the job is throttled.
+func Postpone(delay time.Duration) error {
+	return &RetryError{
+		Delay: delay,
+	}
+}
+
+func asRetry(err error) (*RetryError, bool) {
+	var retry *RetryError
+	if errors.As(err, &retry) {
+		return retry, true
+	}
+	return nil, false
+}
+
+// scheduler keeps jobs which must be put to the queue later.
+type scheduler struct {
+	pool *Pool
+	mu   sync.Mutex
+	jobs scheduledHeap
+	// Amount of due jobs which are being moved to the queue
+	moving int
+	wakeup chan struct{}
+}
+
+type scheduledJob struct {
+	job job
+	at  time.Time
+}
+
+func newScheduler(pool *Pool) *scheduler {
+	return &scheduler{
+		pool:   pool,
+		wakeup: make(chan struct{}, 1),
+	}
+}
+
+func (s *scheduler) add(j job, at time.Time) {
+	s.mu.Lock()
+	heap.Push(&s.jobs, &scheduledJob{job: j, at: at})
+	first := s.jobs[0].job.id == j.id
+	s.mu.Unlock()
+	if first {
+		select {
+		case s.wakeup <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// remove takes the job out of the scheduler, jobs being moved to the queue are not found.
+func (s *scheduler) remove(id uint64) (job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sj := range s.jobs {
+		if sj.job.id == id {
+			heap.Remove(&s.jobs, i)
+			return sj.job, true
+		}
+	}
+	return job{}, false
+}
+
+func (s *scheduler) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.jobs) + s.moving
+}
+
+// drainDelayed removes jobs which are delayed by the RunAt option and are not due yet.
+func (s *scheduler) drainDelayed() []job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var jobs []job
+	kept := s.jobs[:0]
+	for _, sj := range s.jobs {
+		if sj.job.runAt.After(now) {
+			jobs = append(jobs, sj.job)
+		} else {
+			kept = append(kept, sj)
+		}
+	}
+	for i := len(kept); i < len(s.jobs); i++ {
+		s.jobs[i] = nil
+	}
+	s.jobs = kept
+	heap.Init(&s.jobs)
+	return jobs
+}
+
+// drain removes all scheduled jobs.
+func (s *scheduler) drain() []job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]job, len(s.jobs))
+	for i, sj := range s.jobs {
+		jobs[i] = sj.job
+	}
+	s.jobs = nil
+	return jobs
+}
+
+func (s *scheduler) run() {
+	timer := time.NewTimer(time.Hour)
+	for {
+		s.mu.Lock()
+		now := time.Now()
+		var due []job
+		for len(s.jobs) > 0 && !s.jobs[0].at.After(now) {
+			due = append(due, heap.Pop(&s.jobs).(*scheduledJob).job)
+		}
+		s.moving = len(due)
+		wait := time.Hour
+		if len(s.jobs) > 0 {
+			wait = s.jobs[0].at.Sub(now)
+		}
+		s.mu.Unlock()
+
+		// Blocks while the queue is full
+		for _, j := range due {
+			s.pool.statuses.requeued(j.id)
+			s.pool.jobsQueue.push(j)
+		}
+		s.mu.Lock()
+		s.moving = 0
+		s.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-s.wakeup:
+		}
+	}
+}
+
+type scheduledHeap []*scheduledJob
+
+func (h scheduledHeap) Len() int           { return len(h) }
+func (h scheduledHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h scheduledHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *scheduledHeap) Push(x any)        { *h = append(*h, x.(*scheduledJob)) }
+func (h *scheduledHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return x
+}
@@ -0,0 +1,210 @@
+package worker
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ReneKroon/ttlcache/v2"
+)
+
+type State string
+
+const (
+	StateQueued    State = "queued"
+	StateScheduled State = "scheduled"
+	StateWaiting   State = "waiting"
+	StateRunning   State = "running"
+	StateSucceeded State = "succeeded"
+	StateFailed    State = "failed"
+	StateCancelled State = "cancelled"
+)
+
+// Finished returns true if the job is in the final state.
+func (s State) Finished() bool {
+	return s == StateSucceeded || s == StateFailed || s == StateCancelled
+}
+
+// Reporter is implemented by job data which can describe the result of the last run,
+// the report is saved to JobStatus.Result.
+type Reporter interface {
+	Report() any
+}
+
+// Releaser is implemented by job data which must be recycled when the job is finished.
+type Releaser interface {
+	Release()
+}
+
+type JobStatus struct {
+	ID       uint64     `json:"id,string"`
+	Action   string     `json:"action"`
+	Priority Priority   `json:"priority"`
+	State    State      `json:"state"`
+	Attempts int        `json:"attempts"`
+	Queued   time.Time  `json:"queued"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Result   any        `json:"result,omitempty"`
+}
+
+// statusStore keeps statuses of recent jobs. Statuses expire after ttl since the
+// last update, and the oldest are evicted when there are more than limit of them.
+type statusStore struct {
+	mu    sync.Mutex
+	cache *ttlcache.Cache
+}
+
+func newStatusStore(ttl time.Duration, limit int) *statusStore {
+	s := &statusStore{
+		cache: ttlcache.NewCache(),
+	}
+	s.cache.SkipTTLExtensionOnHit(true)
+	_ = s.cache.SetTTL(ttl)
+	s.cache.SetCacheSizeLimit(limit)
+	return s
+}
+
+func (s *statusStore) added(j *job, state State) {
+	if s == nil {
+		return
+	}
+	_ = s.cache.Set(strconv.FormatUint(j.id, 10), &JobStatus{
+		ID:       j.id,
+		Action:   j.action,
+		Priority: j.priority,
+		State:    state,
+		Queued:   time.Now(),
+	})
+}
+
+func (s *statusStore) update(id uint64, fn func(status *JobStatus)) {
+	if s == nil {
+		return
+	}
+	key := strconv.FormatUint(id, 10)
+	val, err := s.cache.Get(key)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	fn(val.(*JobStatus))
+	s.mu.Unlock()
+	// Extends ttl
+	_ = s.cache.Set(key, val)
+}
+
+func (s *statusStore) running(id uint64) {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	s.update(id, func(status *JobStatus) {
+		status.State = StateRunning
+		status.Attempts++
+		status.Started = &now
+	})
+}
+
+// scheduled marks the job which waits for the next attempt
+func (s *statusStore) scheduled(id uint64, err error) {
+	if s == nil {
+		return
+	}
+	s.update(id, func(status *JobStatus) {
+		status.State = StateScheduled
+		status.Error = err.Error()
+	})
+}
+
+// postponed marks the job which waits without making an attempt
+func (s *statusStore) postponed(id uint64) {
+	if s == nil {
+		return
+	}
+	s.update(id, func(status *JobStatus) {
+		status.State = StateScheduled
+		status.Attempts--
+	})
+}
+
+func (s *statusStore) requeued(id uint64) {
+	if s == nil {
+		return
+	}
+	s.update(id, func(status *JobStatus) {
+		status.State = StateQueued
+	})
+}
+
+// released marks the job whose dependencies are succeeded
+func (s *statusStore) released(id uint64, state State) {
+	if s == nil {
+		return
+	}
+	s.update(id, func(status *JobStatus) {
+		status.State = state
+	})
+}
+
+// interrupted marks the running job which is interrupted by shutdown. The job kept in the
+// journal is queued again on the next start, the dropped job is failed.
+func (s *statusStore) interrupted(id uint64, data any, err error, kept bool) {
+	if s == nil {
+		return
+	}
+	if !kept {
+		s.finished(id, data, err)
+		return
+	}
+	s.update(id, func(status *JobStatus) {
+		status.State = StateQueued
+		status.Error = err.Error()
+	})
+}
+
+func (s *statusStore) finished(id uint64, data any, err error) {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	var result any
+	if r, ok := data.(Reporter); ok {
+		result = r.Report()
+	}
+	s.update(id, func(status *JobStatus) {
+		if err == ErrCancelled {
+			status.State = StateCancelled
+			status.Error = ""
+		} else if err != nil {
+			status.State = StateFailed
+			status.Error = err.Error()
+		} else {
+			status.State = StateSucceeded
+			status.Error = ""
+		}
+		status.Finished = &now
+		status.Result = result
+	})
+}
+
+func (s *statusStore) get(id uint64) (JobStatus, bool) {
+	if s == nil {
+		return JobStatus{}, false
+	}
+	val, err := s.cache.Get(strconv.FormatUint(id, 10))
+	if err != nil {
+		return JobStatus{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *val.(*JobStatus), true
+}
+
+func (s *statusStore) remove(id uint64) {
+	if s == nil {
+		return
+	}
+	_ = s.cache.Remove(strconv.FormatUint(id, 10))
+}
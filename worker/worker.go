@@ -1,48 +1,175 @@
 package worker
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type worker struct {
-	pool     *Pool
-	jobsChan chan job
-	quit     chan *sync.WaitGroup
+	pool  *Pool
+	shard int
+	quit  chan *sync.WaitGroup
 }
 
 func (w *worker) start() {
-	w.jobsChan = make(chan job, 1)
 	w.quit = make(chan *sync.WaitGroup, 1)
 
 	go func() {
 		for {
-			w.pool.freeWorkers <- w
-
-			select {
-			case job := <-w.jobsChan:
-				w.doJob(job)
-
-			case wg := <-w.quit:
+			job, wg := w.pool.jobsQueue.take(w.shard, w.quit)
+			if wg != nil {
 				wg.Done()
 				return
 			}
+			atomic.AddInt64(&w.pool.waitSum, int64(time.Since(job.pushed)))
+			atomic.AddInt64(&w.pool.waitCount, 1)
+			w.dispatch(job)
+			w.pool.jobsQueue.done()
 		}
 	}()
 }
 
+// dispatch runs the job taken from the queue unless it must wait.
+func (w *worker) dispatch(job job) {
+	p := w.pool
+	if p.ctx.Err() != nil {
+		// The pool is interrupted, jobs are not started anymore
+		p.abandon(&job)
+		return
+	}
+	if p.canceller.isCancelled(job.id) {
+		// Later jobs with the coalesce key must not be merged into the cancelled job
+		p.coalescer.take(&job)
+		p.complete(job, ErrCancelled)
+		return
+	}
+	p.coalescer.take(&job)
+	if !p.sequencer.acquire(&job) {
+		// The job waits for the previous job with its ordering key
+		return
+	}
+	if job.limitKeys == nil {
+		job.limitKeys = p.limitKeys(&job)
+	}
+	if !p.limiter.acquire(&job) {
+		// The job waits in the limiter and does not occupy a worker
+		return
+	}
+	w.doJob(job)
+}
+
 func (w *worker) doJob(job job) {
+	p := w.pool
+	job.attempts++
+	job.started = time.Now()
+	p.statuses.running(job.id)
+	atomic.AddInt32(&p.running, 1)
+	if a, ok := p.actions[job.action]; ok && a.async != nil {
+		// Wait for the in-flight budget, the worker is busy meanwhile
+		a.inFlight <- struct{}{}
+		p.startAsync(p.startAttempt(&job), a, job)
+		return
+	}
+	p.jobDone(job, w.handle(p.startAttempt(&job), job))
+}
+
+// startAsync starts the job of the async action, it is finished when the handler calls done.
+func (p *Pool) startAsync(ctx context.Context, a *action, job job) {
+	var called int32
+	done := func(err error) {
+		if !atomic.CompareAndSwapInt32(&called, 0, 1) {
+			return
+		}
+		<-a.inFlight
+		p.jobDone(job, err)
+	}
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in job %s: %s", job.action, r)
+			done(fmt.Errorf("panic: %v", r))
 		}
 	}()
+	a.async(ctx, job.data, done)
+}
 
-	if handler, ok := w.pool.handlers[job.action]; ok {
-		if err := handler(job.data); err != nil {
-			log.Printf("%s is failed: %s", job.action, err.Error())
+// jobDone handles the result of the attempt: schedules the retry or finishes the job.
+func (p *Pool) jobDone(job job, err error) {
+	defer atomic.AddInt32(&p.running, -1)
+	p.attemptDone(&job)
+	p.releaseSlots(&job)
+	if err != nil && p.ctx.Err() != nil {
+		p.interrupted(job, err)
+		return
+	}
+	if err != nil && p.canceller.isCancelled(job.id) {
+		// The aborted or cancelled job is not retried
+		p.complete(job, ErrCancelled)
+		return
+	}
+	if retry, ok := asRetry(err); ok {
+		if retry.Err == nil {
+			// Postponed job did not make an attempt
+			job.attempts--
+			p.statuses.postponed(job.id)
+		} else {
+			p.statuses.scheduled(job.id, retry.Err)
 		}
-	} else {
-		log.Printf("Unknown job action: %s", job.action)
+		p.scheduler.add(job, time.Now().Add(retry.Delay))
+		return
+	}
+	p.complete(job, err)
+}
+
+// complete finishes the succeeded or finally failed job.
+func (p *Pool) complete(job job, err error) {
+	if err != nil && p.canceller.isCancelled(job.id) {
+		// Cancelled jobs are not dead letters, even if their dependencies failed
+		err = ErrCancelled
+	}
+	if err == ErrCancelled {
+		log.Printf("%s %d is cancelled", job.action, job.id)
+		mCancelledJobs.Inc()
+	} else if err != nil {
+		log.Printf("%s %d is failed: %s", job.action, job.id, err.Error())
+		p.deadLetter(job, err)
+	}
+	// The job cancelled before it started may hold slots handed to it by the limiter
+	p.releaseSlots(&job)
+	p.statuses.finished(job.id, job.data, err)
+	p.canceller.done(&job)
+	p.journalDone(job)
+	p.sequenceDone(&job)
+	p.finished(&job, err)
+	release(job.data)
+	p.dependenciesDone(&job, err == nil)
+}
+
+// releaseSlots frees limiter slots of the job and starts waiting jobs which got them.
+func (p *Pool) releaseSlots(j *job) {
+	for _, ready := range p.limiter.release(j) {
+		// Do not block the worker, the scheduler moves jobs to the queue
+		p.scheduler.add(ready, time.Now())
+	}
+}
+
+func (w *worker) handle(ctx context.Context, job job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	if a, ok := w.pool.actions[job.action]; ok {
+		return a.handler(ctx, job.data)
+	}
+	return fmt.Errorf("unknown job action: %s", job.action)
+}
+
+func release(data any) {
+	if r, ok := data.(Releaser); ok {
+		r.Release()
 	}
 }